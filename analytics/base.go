@@ -17,6 +17,16 @@ func RegisterBackend(b Backend) {
 	backends = append(backends, b)
 }
 
+// RemoveBackend removes a previously registered backend
+func RemoveBackend(b Backend) {
+	for i := range backends {
+		if backends[i] == b {
+			backends = append(backends[:i], backends[i+1:]...)
+			return
+		}
+	}
+}
+
 // Start starts all backends
 func Start() error {
 	for _, b := range backends {
@@ -15,6 +15,8 @@ func TestConsoleBackend(t *testing.T) {
 	assert.Equal(t, "console", b.Name())
 
 	analytics.RegisterBackend(b)
+	defer analytics.RemoveBackend(b)
+
 	assert.NoError(t, analytics.Start())
 
 	analytics.Gauge("foo", 123456)
@@ -1,8 +1,12 @@
 package analytics
 
+import "sync"
+
 // MockBackend is a backend which records values for testing
 type MockBackend struct {
 	Gauges map[string][]float64
+
+	mutex sync.Mutex
 }
 
 // NewMock creates a new mock backend
@@ -19,6 +23,9 @@ func (b *MockBackend) Start() error {
 }
 
 func (b *MockBackend) Gauge(name string, value float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	b.Gauges[name] = append(b.Gauges[name], value)
 }
 
@@ -24,4 +24,10 @@ func TestMockBackend(t *testing.T) {
 		"foo": {123456, 567},
 		"bar": {0.1234},
 	}, b.Gauges)
+
+	// once removed, a backend no longer receives values
+	analytics.RemoveBackend(b)
+	analytics.Gauge("foo", 1)
+
+	assert.Equal(t, []float64{123456, 567}, b.Gauges["foo"])
 }
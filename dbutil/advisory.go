@@ -0,0 +1,130 @@
+package dbutil
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrLockNotAcquired is returned when an advisory lock is held by another session or transaction
+var ErrLockNotAcquired = errors.New("advisory lock not acquired")
+
+// how often we retry acquiring a lock while waiting for it
+const lockPollInterval = 100 * time.Millisecond
+
+// ConnOpener is the DB functionality needed to take session advisory locks which are held by a single connection
+type ConnOpener interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+// LockQueryer is the TX functionality needed to take transaction advisory locks
+type LockQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// AdvisoryLockKey hashes the given string key to the integer key of an advisory lock
+func AdvisoryLockKey(key string) int64 {
+	h := md5.Sum([]byte(key))
+	return int64(binary.BigEndian.Uint64(h[0:8]))
+}
+
+// TryAdvisoryLock tries to acquire the session advisory lock for the given key without waiting, returning a function
+// to release it, or ErrLockNotAcquired. The lock is held by a connection taken from the pool until it is released.
+func TryAdvisoryLock(ctx context.Context, db ConnOpener, key string) (func() error, error) {
+	return AdvisoryLock(ctx, db, key, 0)
+}
+
+// AdvisoryLock acquires the session advisory lock for the given key, waiting up to the given timeout for it to be
+// released by another session. Returns a function to release it, or ErrLockNotAcquired. The lock is held by a connection
+// taken from the pool until it is released, and is released by Postgres if that connection is lost.
+func AdvisoryLock(ctx context.Context, db ConnOpener, key string, timeout time.Duration) (func() error, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, QueryErrorWrapf(err, "", nil, "error getting connection")
+	}
+
+	lockKey := AdvisoryLockKey(key)
+
+	if err := waitForLock(ctx, conn, `SELECT pg_try_advisory_lock($1)`, lockKey, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	release := func() error {
+		defer conn.Close()
+
+		// don't let cancellation of the caller's context prevent the release
+		ctx := context.WithoutCancel(ctx)
+
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			// we don't know if the lock is still held, so discard the connection rather than return it to the pool,
+			// and the lock is released by Postgres when the session ends
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+
+			return QueryErrorWrapf(err, `SELECT pg_advisory_unlock($1)`, []any{lockKey}, "error releasing advisory lock")
+		}
+		return nil
+	}
+
+	return release, nil
+}
+
+// WithAdvisoryLock runs the given function while holding the session advisory lock for the given key, waiting up to the
+// given timeout to acquire it. Returns ErrLockNotAcquired if the lock couldn't be acquired.
+func WithAdvisoryLock(ctx context.Context, db ConnOpener, key string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	release, err := AdvisoryLock(ctx, db, key, timeout)
+	if err != nil {
+		return err
+	}
+
+	fnErr := fn(ctx)
+
+	if err := release(); err != nil && fnErr == nil {
+		return err
+	}
+	return fnErr
+}
+
+// TryAdvisoryXactLock tries to acquire the transaction advisory lock for the given key without waiting, returning
+// ErrLockNotAcquired if it's held elsewhere. The lock is released when the transaction ends.
+func TryAdvisoryXactLock(ctx context.Context, tx LockQueryer, key string) error {
+	return AdvisoryXactLock(ctx, tx, key, 0)
+}
+
+// AdvisoryXactLock acquires the transaction advisory lock for the given key, waiting up to the given timeout for it to
+// be released elsewhere, and returning ErrLockNotAcquired if it isn't. The lock is released when the transaction ends.
+// Unlike a timeout of a blocking lock, failing to acquire the lock doesn't abort the transaction.
+func AdvisoryXactLock(ctx context.Context, tx LockQueryer, key string, timeout time.Duration) error {
+	return waitForLock(ctx, tx, `SELECT pg_try_advisory_xact_lock($1)`, AdvisoryLockKey(key), timeout)
+}
+
+// tries to acquire a lock until it succeeds or the timeout expires. We poll rather than use a blocking lock with a lock
+// timeout because that would abort an ongoing transaction.
+func waitForLock(ctx context.Context, q LockQueryer, query string, key int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var acquired bool
+		if err := q.QueryRowContext(ctx, query, key).Scan(&acquired); err != nil {
+			return QueryErrorWrapf(err, query, []any{key}, "error acquiring advisory lock")
+		}
+		if acquired {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrLockNotAcquired
+		}
+
+		select {
+		case <-time.After(min(remaining, lockPollInterval)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
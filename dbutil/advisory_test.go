@@ -0,0 +1,106 @@
+package dbutil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvisoryLockKey(t *testing.T) {
+	assert.Equal(t, dbutil.AdvisoryLockKey("foo"), dbutil.AdvisoryLockKey("foo"))
+	assert.NotEqual(t, dbutil.AdvisoryLockKey("foo"), dbutil.AdvisoryLockKey("bar"))
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	ctx := context.Background()
+	db := getTestDB()
+
+	release1, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	require.NoError(t, err)
+
+	// lock is held by another session
+	_, err = dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	assert.Equal(t, dbutil.ErrLockNotAcquired, err)
+
+	start := time.Now()
+	_, err = dbutil.AdvisoryLock(ctx, db, "cron:foo", 250*time.Millisecond)
+	assert.Equal(t, dbutil.ErrLockNotAcquired, err)
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	// but a different key can be locked
+	release2, err := dbutil.TryAdvisoryLock(ctx, db, "cron:bar")
+	require.NoError(t, err)
+	assert.NoError(t, release2())
+
+	// lock can be acquired after waiting for it to be released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		release1()
+	}()
+
+	release3, err := dbutil.AdvisoryLock(ctx, db, "cron:foo", time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, release3())
+
+	// or run a function while holding the lock, which is released after
+	err = dbutil.WithAdvisoryLock(ctx, db, "cron:foo", 0, func(ctx context.Context) error {
+		_, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+		assert.Equal(t, dbutil.ErrLockNotAcquired, err)
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+
+	release4, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	require.NoError(t, err)
+	assert.NoError(t, release4())
+
+	// all connections have been returned to the pool
+	assert.Equal(t, 0, db.Stats().InUse)
+
+	// transaction scoped locks are released when the transaction ends
+	tx1 := db.MustBegin()
+	assert.NoError(t, dbutil.TryAdvisoryXactLock(ctx, tx1, "cron:foo"))
+
+	tx2 := db.MustBegin()
+	assert.Equal(t, dbutil.ErrLockNotAcquired, dbutil.TryAdvisoryXactLock(ctx, tx2, "cron:foo"))
+	assert.Equal(t, dbutil.ErrLockNotAcquired, dbutil.AdvisoryXactLock(ctx, tx2, "cron:foo", 150*time.Millisecond))
+
+	// and they conflict with session locks
+	_, err = dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	assert.Equal(t, dbutil.ErrLockNotAcquired, err)
+
+	require.NoError(t, tx1.Commit())
+
+	// failing to get the lock didn't abort the transaction so it can still get it
+	assert.NoError(t, dbutil.TryAdvisoryXactLock(ctx, tx2, "cron:foo"))
+	require.NoError(t, tx2.Rollback())
+
+	// if releasing fails, the connection is discarded rather than returned to the pool still holding the lock
+	release5, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	require.NoError(t, err)
+
+	db.MustExec(`SELECT pg_terminate_backend(pid) FROM pg_locks WHERE locktype = 'advisory' AND pid != pg_backend_pid()`)
+
+	assert.Error(t, release5())
+	assert.Equal(t, 0, db.Stats().InUse)
+
+	release6, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	require.NoError(t, err)
+	assert.NoError(t, release6())
+
+	// waiting for a lock stops if the context is cancelled
+	release7, err := dbutil.TryAdvisoryLock(ctx, db, "cron:foo")
+	require.NoError(t, err)
+	defer release7()
+
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	_, err = dbutil.AdvisoryLock(cctx, db, "cron:foo", time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -2,6 +2,7 @@ package assertdb
 
 import (
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
@@ -49,3 +50,62 @@ func (q *TestQuery) Columns(expected map[string]any, msgAndArgs ...any) bool {
 	assert.NoError(q.t, err, msgAndArgs...)
 	return assert.Equal(q.t, expected, actual, msgAndArgs...)
 }
+
+// RowCount asserts that the query returns the given number of rows
+func (q *TestQuery) RowCount(expected int, msgAndArgs ...any) bool {
+	q.t.Helper()
+
+	rows := queryRows(q.t, q.db, q.sql, q.args...)
+	return assert.Len(q.t, rows, expected, msgAndArgs...)
+}
+
+// Rows asserts that the query returns the given rows in the given order. Unlike Columns, byte slices are compared as
+// strings and times in UTC.
+func (q *TestQuery) Rows(expected []map[string]any, msgAndArgs ...any) bool {
+	q.t.Helper()
+
+	actual := queryRows(q.t, q.db, q.sql, q.args...)
+	return assert.Equal(q.t, expected, actual, msgAndArgs...)
+}
+
+// RowsUnordered asserts that the query returns the given rows in any order
+func (q *TestQuery) RowsUnordered(expected []map[string]any, msgAndArgs ...any) bool {
+	q.t.Helper()
+
+	actual := queryRows(q.t, q.db, q.sql, q.args...)
+	return assert.ElementsMatch(q.t, expected, actual, msgAndArgs...)
+}
+
+// queries all rows as maps of column values, with byte slices converted to strings and times to UTC for easier comparison
+func queryRows(t *testing.T, db *sqlx.DB, sql string, args ...any) []map[string]any {
+	t.Helper()
+
+	rows, err := db.Queryx(sql, args...)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer rows.Close()
+
+	all := make([]map[string]any, 0)
+
+	for rows.Next() {
+		row := make(map[string]any)
+		if !assert.NoError(t, rows.MapScan(row)) {
+			return nil
+		}
+
+		for k, v := range row {
+			switch typed := v.(type) {
+			case []byte:
+				row[k] = string(typed)
+			case time.Time:
+				row[k] = typed.UTC()
+			}
+		}
+
+		all = append(all, row)
+	}
+
+	assert.NoError(t, rows.Err())
+	return all
+}
@@ -0,0 +1,143 @@
+package assertdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFixturesFile loads fixtures from the given YAML or JSON file. See LoadFixtures.
+func LoadFixturesFile(t *testing.T, db *sqlx.DB, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	LoadFixtures(t, db, data)
+}
+
+// LoadFixtures seeds tables with the rows in the given YAML or JSON which maps table names to lists of rows, e.g.
+//
+//	orgs:
+//	  - id: 1
+//	    name: Nyaruka
+//	users:
+//	  - id: 1
+//	    org_id: 1
+//	    email: bob@nyaruka.com
+//	    config: {"admin": true}
+//
+// Tables are truncated before rows are inserted, in the order they're listed, and truncated again when the test ends.
+// Truncating doesn't cascade so tables with foreign keys to fixture tables must be included in the fixtures. Object
+// and array values are inserted as JSON. If rows have an integer id column with a sequence, the sequence is updated to
+// follow them.
+func LoadFixtures(t *testing.T, db *sqlx.DB, data []byte) {
+	t.Helper()
+
+	// decode to a node so that we can preserve the order of tables
+	var doc yaml.Node
+	require.NoError(t, yaml.Unmarshal(data, &doc), "error parsing fixtures")
+	require.Len(t, doc.Content, 1, "fixtures should be a single document")
+
+	root := doc.Content[0]
+	require.Equal(t, yaml.MappingNode, root.Kind, "fixtures should map table names to rows")
+
+	tables := make([]string, 0, len(root.Content)/2)
+	for i := 0; i < len(root.Content); i += 2 {
+		tables = append(tables, root.Content[i].Value)
+	}
+
+	truncate := func() {
+		if len(tables) == 0 {
+			return
+		}
+
+		quoted := make([]string, len(tables))
+		for i, table := range tables {
+			quoted[i] = pq.QuoteIdentifier(table)
+		}
+		db.MustExec(fmt.Sprintf(`TRUNCATE %s RESTART IDENTITY`, strings.Join(quoted, ", ")))
+	}
+
+	truncate()
+	t.Cleanup(truncate)
+
+	for i, table := range tables {
+		var rows []map[string]any
+		require.NoError(t, root.Content[i*2+1].Decode(&rows), "error parsing fixture rows for table %s", table)
+
+		hasIDs := false
+		for _, row := range rows {
+			insertFixture(t, db, table, row)
+
+			if _, ok := row["id"]; ok {
+				hasIDs = true
+			}
+		}
+
+		if hasIDs {
+			updateIDSequence(t, db, table)
+		}
+	}
+}
+
+// updates the sequence of the id column of the given table to follow its rows, if it's an integer with a sequence
+func updateIDSequence(t *testing.T, db *sqlx.DB, table string) {
+	t.Helper()
+
+	var sequence sql.NullString
+	var idType string
+	err := db.QueryRow(
+		`SELECT pg_get_serial_sequence($1, 'id'), atttypid::regtype::text FROM pg_attribute WHERE attrelid = $1::regclass AND attname = 'id'`,
+		pq.QuoteIdentifier(table),
+	).Scan(&sequence, &idType)
+	require.NoError(t, err, "error looking up id sequence for table %s", table)
+
+	if !sequence.Valid || (idType != "smallint" && idType != "integer" && idType != "bigint") {
+		return
+	}
+
+	db.MustExec(fmt.Sprintf(`SELECT setval($1, max(id)) FROM %s`, pq.QuoteIdentifier(table)), sequence.String)
+}
+
+func insertFixture(t *testing.T, db *sqlx.DB, table string, row map[string]any) {
+	t.Helper()
+
+	// sort columns so that inserts are deterministic
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	args := make([]any, len(columns))
+
+	for i, c := range columns {
+		quoted[i] = pq.QuoteIdentifier(c)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+
+		switch v := row[c].(type) {
+		case map[string]any, []any:
+			j, err := json.Marshal(v)
+			require.NoError(t, err)
+			args[i] = string(j)
+		default:
+			args[i] = v
+		}
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s (%s) VALUES(%s)`, pq.QuoteIdentifier(table), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	_, err := db.Exec(sql, args...)
+	require.NoError(t, err, "error inserting fixture into %s", table)
+}
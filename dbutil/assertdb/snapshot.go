@@ -0,0 +1,100 @@
+package assertdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// Snapshot is a snapshot of the rows of a table which can be compared against its rows later
+type Snapshot struct {
+	t     *testing.T
+	db    *sqlx.DB
+	table string
+	key   string
+	rows  []map[string]any
+}
+
+// TakeSnapshot takes a snapshot of all rows in the given table, identified by the given key column, e.g. id
+func TakeSnapshot(t *testing.T, db *sqlx.DB, table, key string) *Snapshot {
+	t.Helper()
+
+	s := &Snapshot{t: t, db: db, table: table, key: key}
+	s.rows = s.query()
+	return s
+}
+
+// TableDiff is the difference between the rows of a table and a snapshot of it
+type TableDiff struct {
+	Added   []map[string]any
+	Changed []map[string]any // new values of changed rows
+	Removed []map[string]any
+}
+
+// Diff compares the current rows of the table to the snapshot
+func (s *Snapshot) Diff() *TableDiff {
+	s.t.Helper()
+
+	before := make(map[string]map[string]any, len(s.rows))
+	for _, row := range s.rows {
+		before[fmt.Sprint(row[s.key])] = row
+	}
+
+	diff := &TableDiff{Added: []map[string]any{}, Changed: []map[string]any{}, Removed: []map[string]any{}}
+	seen := make(map[string]bool, len(s.rows))
+
+	for _, row := range s.query() {
+		k := fmt.Sprint(row[s.key])
+		seen[k] = true
+
+		if old, found := before[k]; !found {
+			diff.Added = append(diff.Added, row)
+		} else if !assert.ObjectsAreEqual(old, row) {
+			diff.Changed = append(diff.Changed, row)
+		}
+	}
+
+	for _, row := range s.rows {
+		if !seen[fmt.Sprint(row[s.key])] {
+			diff.Removed = append(diff.Removed, row)
+		}
+	}
+
+	return diff
+}
+
+// Unchanged asserts that no rows have been added, changed or removed since the snapshot
+func (s *Snapshot) Unchanged(msgAndArgs ...any) bool {
+	s.t.Helper()
+
+	return s.OnlyChanged(nil, msgAndArgs...)
+}
+
+// OnlyChanged asserts that only the rows with the given keys have been added, changed or removed since the snapshot
+func (s *Snapshot) OnlyChanged(keys []any, msgAndArgs ...any) bool {
+	s.t.Helper()
+
+	expected := make([]string, len(keys))
+	for i, k := range keys {
+		expected[i] = fmt.Sprint(k)
+	}
+
+	diff := s.Diff()
+	actual := make([]string, 0, len(diff.Added)+len(diff.Changed)+len(diff.Removed))
+	for _, rows := range [][]map[string]any{diff.Added, diff.Changed, diff.Removed} {
+		for _, row := range rows {
+			actual = append(actual, fmt.Sprint(row[s.key]))
+		}
+	}
+
+	return assert.ElementsMatch(s.t, expected, actual, msgAndArgs...)
+}
+
+func (s *Snapshot) query() []map[string]any {
+	s.t.Helper()
+
+	return queryRows(s.t, s.db, fmt.Sprintf(`SELECT * FROM %s ORDER BY %s`, pq.QuoteIdentifier(s.table), pq.QuoteIdentifier(s.key)))
+}
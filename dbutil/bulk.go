@@ -2,9 +2,13 @@ package dbutil
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -18,6 +22,10 @@ type BulkQueryer interface {
 // BulkSQL takes a query which uses VALUES with struct bindings and rewrites it as a bulk operation.
 // It returns the new SQL query and the args to pass to it.
 func BulkSQL[T any](db BulkQueryer, sql string, structs []T) (string, []any, error) {
+	return bulkSQL(db, sql, structs, false)
+}
+
+func bulkSQL[T any](db BulkQueryer, sql string, structs []T, castValues bool) (string, []any, error) {
 	if len(structs) == 0 {
 		return "", nil, errors.New("can't generate bulk sql with zero structs")
 	}
@@ -29,6 +37,16 @@ func BulkSQL[T any](db BulkQueryer, sql string, structs []T) (string, []any, err
 	// this will be each of the arguments to match the positional values above
 	args := make([]any, 0, len(structs)*5)
 
+	// if casting, work out where the args of the values tuple are, which is the same for every struct
+	var argOffset int
+	var argCounts []int
+	if castValues {
+		var err error
+		if argOffset, argCounts, err = tupleArgs(sql, structs[0]); err != nil {
+			return "", nil, fmt.Errorf("error converting bulk insert args: %w", err)
+		}
+	}
+
 	// for each value we build a bound SQL statement, then extract the values clause
 	for i, value := range structs {
 		valueSQL, valueArgs, err := sqlx.Named(sql, value)
@@ -41,6 +59,9 @@ func BulkSQL[T any](db BulkQueryer, sql string, structs []T) (string, []any, err
 		if argValues == "" {
 			return "", nil, fmt.Errorf("error extracting VALUES from sql: %s", valueSQL)
 		}
+		if castValues {
+			argValues = castPlaceholders(argValues, argOffset, argCounts, valueArgs)
+		}
 
 		// append to our global values, adding comma if necessary
 		values.WriteString(argValues)
@@ -57,13 +78,56 @@ func BulkSQL[T any](db BulkQueryer, sql string, structs []T) (string, []any, err
 	return db.Rebind(strings.Replace(sql, valuesSQL, values.String(), -1)), args, nil
 }
 
-// BulkQuery runs the query as a bulk operation with the given structs
+// MaxBulkParams is the maximum number of bind parameters that Postgres allows in a single query
+const MaxBulkParams = 65535
+
+// BulkQuery runs the query as a bulk operation with the given structs, split into as many queries as needed to stay
+// within the bind parameter limit
 func BulkQuery[T any](ctx context.Context, db BulkQueryer, query string, structs []T) error {
+	return BulkQueryChunked(ctx, db, query, structs, 0)
+}
+
+// BulkQueryChunked runs the query as a bulk operation with the given structs, split into queries of at most `maxRows`
+// structs (zero meaning no limit) and within the bind parameter limit. Queries are run in sequence so if the queryer
+// is a transaction, they all succeed or fail together. Rows from a RETURNING clause are scanned into the structs.
+func BulkQueryChunked[T any](ctx context.Context, db BulkQueryer, query string, structs []T, maxRows int) error {
 	// no structs, nothing to do
 	if len(structs) == 0 {
 		return nil
 	}
 
+	chunkSize, err := bulkChunkSize(query, structs[0], maxRows)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(structs); start += chunkSize {
+		if err := bulkQuery(ctx, db, query, structs[start:min(start+chunkSize, len(structs))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// works out how many structs can be included in each query
+func bulkChunkSize[T any](query string, s T, maxRows int) (int, error) {
+	_, args, err := sqlx.Named(query, s)
+	if err != nil {
+		return 0, fmt.Errorf("error converting bulk insert args: %w", err)
+	}
+
+	size := MaxBulkParams
+	if len(args) > 0 {
+		size = MaxBulkParams / len(args)
+	}
+	if maxRows > 0 {
+		size = min(size, maxRows)
+	}
+	return size, nil
+}
+
+// runs a single bulk query with the given structs
+func bulkQuery[T any](ctx context.Context, db BulkQueryer, query string, structs []T) error {
 	// rewrite query as a bulk operation
 	bulkQuery, args, err := BulkSQL(db, query, structs)
 	if err != nil {
@@ -130,3 +194,190 @@ func extractValues(sql string) string {
 
 	return sql[startValues+6 : endValues+1]
 }
+
+// BulkUpdate runs an update query which joins to a VALUES table with struct bindings, as a bulk operation with the
+// given structs, e.g.
+//
+//	UPDATE foo SET name = v.name FROM (VALUES(:id, :name)) AS v(id, name) WHERE foo.id = v.id
+//
+// Bare params in the VALUES clause are cast to types inferred from the struct field values so that the columns of the
+// VALUES table are typed. Params which can't be inferred, e.g. JSON stored in a string, can be cast in the query.
+func BulkUpdate[T any](ctx context.Context, db BulkQueryer, query string, structs []T) error {
+	_, err := bulkUpdate[struct{}](ctx, db, query, structs, false)
+	return err
+}
+
+// BulkUpdateReturning is the same as BulkUpdate but scans the rows from a RETURNING clause into new values of type R.
+// Note that the returned rows aren't in any particular order.
+func BulkUpdateReturning[R, T any](ctx context.Context, db BulkQueryer, query string, structs []T) ([]R, error) {
+	return bulkUpdate[R](ctx, db, query, structs, true)
+}
+
+func bulkUpdate[R, T any](ctx context.Context, db BulkQueryer, query string, structs []T, scan bool) ([]R, error) {
+	if len(structs) == 0 {
+		return nil, nil
+	}
+
+	chunkSize, err := bulkChunkSize(query, structs[0], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]R, 0)
+
+	for start := 0; start < len(structs); start += chunkSize {
+		chunk := structs[start:min(start+chunkSize, len(structs))]
+
+		bulkQuery, args, err := bulkSQL(db, query, chunk, true)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := db.QueryxContext(ctx, bulkQuery, args...)
+		if err != nil {
+			return nil, QueryErrorWrapf(err, bulkQuery, args, "error making bulk update")
+		}
+
+		for rows.Next() {
+			if scan {
+				var r R
+				if err := rows.StructScan(&r); err != nil {
+					rows.Close()
+					return nil, QueryErrorWrapf(err, bulkQuery, args, "error scanning returned row")
+				}
+				results = append(results, r)
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, QueryErrorWrapf(err, bulkQuery, args, "error during row iteration")
+		}
+	}
+
+	return results, nil
+}
+
+// works out the number of args which precede the values tuple in a named query, and the number of args in each of the
+// tuple's elements. We count the named params rather than bind vars in the bound query, as a literal ? in the query,
+// e.g. in a string or a jsonb operator, isn't a bind var.
+func tupleArgs(sql string, arg any) (int, []int, error) {
+	tuple := extractValues(sql)
+	if tuple == "" {
+		return 0, nil, nil // caller will error when extracting values from the bound query
+	}
+
+	offset, err := countNamedArgs(sql[:strings.Index(sql, tuple)], arg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	elems := splitTopLevel(tuple[1 : len(tuple)-1])
+	counts := make([]int, len(elems))
+	for i, elem := range elems {
+		if counts[i], err = countNamedArgs(elem, arg); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return offset, counts, nil
+}
+
+func countNamedArgs(sql string, arg any) (int, error) {
+	_, args, err := sqlx.Named(sql, arg)
+	return len(args), err
+}
+
+// casts the bare placeholders in a values tuple like (?, ?, CAST(? AS jsonb)) to types inferred from the args, where
+// argOffset is the index of the first arg in the tuple and argCounts the number of args in each element of the tuple
+func castPlaceholders(tuple string, argOffset int, argCounts []int, args []any) string {
+	argIndex := argOffset
+	inner := tuple[1 : len(tuple)-1]
+	elems := splitTopLevel(inner)
+
+	for i, elem := range elems {
+		if argCounts[i] == 1 && strings.TrimSpace(elem) == "?" && argIndex < len(args) {
+			if pgType := inferPgType(args[argIndex]); pgType != "" {
+				elems[i] = strings.Replace(elem, "?", "CAST(? AS "+pgType+")", 1)
+			}
+		}
+		argIndex += argCounts[i]
+	}
+
+	return "(" + strings.Join(elems, ",") + ")"
+}
+
+// splits a SQL expression list on commas which aren't inside parentheses or quotes
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	inQuote := false
+
+	for i, r := range s {
+		switch {
+		case r == '\'':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	valuerType     = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// infers the Postgres type for a Go value, returning empty string if it can't be inferred
+func inferPgType(v any) string {
+	if v == nil {
+		return ""
+	}
+
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer && !t.Implements(valuerType) {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return "timestamptz"
+	case t == rawMessageType:
+		return "jsonb"
+	case t.Implements(valuerType):
+		// we'd need a non-nil value to know what the valuer returns
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Pointer && rv.IsNil() {
+			return ""
+		}
+		dv, err := v.(driver.Valuer).Value()
+		if err != nil || dv == nil {
+			return ""
+		}
+		return inferPgType(dv)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "bigint"
+	case reflect.Float32, reflect.Float64:
+		return "double precision"
+	case reflect.String:
+		return "text"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+)
+
+// CopyQueryer is the TX functionality needed for copy operations. Note that copying requires a transaction.
+type CopyQueryer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// BulkCopy streams the given structs into the given table, which may be schema qualified, using COPY FROM STDIN.
+// Columns are derived from the db tags of the struct fields, as they are for named queries.
+func BulkCopy[T any](ctx context.Context, tx CopyQueryer, table string, structs []T) error {
+	if len(structs) == 0 {
+		return nil
+	}
+
+	columns, values, err := copyColumns(structs)
+	if err != nil {
+		return err
+	}
+
+	return bulkCopy(ctx, tx, table, columns, values)
+}
+
+// BulkCopyUpsert streams the given structs into a temporary staging table using COPY FROM STDIN, and then inserts them
+// into the given table, updating the other columns of any existing rows which conflict on the given columns.
+func BulkCopyUpsert[T any](ctx context.Context, tx CopyQueryer, table string, structs []T, conflictColumns []string) error {
+	if len(structs) == 0 {
+		return nil
+	}
+	if len(conflictColumns) == 0 {
+		return errors.New("can't upsert without conflict columns")
+	}
+
+	columns, values, err := copyColumns(structs)
+	if err != nil {
+		return err
+	}
+
+	// temporary tables live in their own schema so the staging table is named after the unqualified table name
+	_, name := splitTableName(table)
+	staging := "staging_" + name
+
+	createSQL := fmt.Sprintf(`CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP`, pq.QuoteIdentifier(staging), quoteTableName(table))
+	if _, err := tx.ExecContext(ctx, createSQL); err != nil {
+		return QueryErrorWrapf(err, createSQL, nil, "error creating staging table")
+	}
+
+	if err := bulkCopy(ctx, tx, staging, columns, values); err != nil {
+		return err
+	}
+
+	// build SET clauses for columns that aren't part of the conflict target
+	sets := make([]string, 0, len(columns))
+	for _, c := range columns {
+		if !containsString(conflictColumns, c) {
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(c), pq.QuoteIdentifier(c)))
+		}
+	}
+
+	onConflict := "DO NOTHING"
+	if len(sets) > 0 {
+		onConflict = "DO UPDATE SET " + strings.Join(sets, ", ")
+	}
+
+	colsSQL := quoteIdentifiers(columns)
+	upsertSQL := fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) %s`, quoteTableName(table), colsSQL, colsSQL, pq.QuoteIdentifier(staging), quoteIdentifiers(conflictColumns), onConflict)
+
+	if _, err := tx.ExecContext(ctx, upsertSQL); err != nil {
+		return QueryErrorWrapf(err, upsertSQL, nil, "error upserting from staging table")
+	}
+
+	// drop the staging table so that we can be called again in the same transaction
+	dropSQL := fmt.Sprintf(`DROP TABLE %s`, pq.QuoteIdentifier(staging))
+	if _, err := tx.ExecContext(ctx, dropSQL); err != nil {
+		return QueryErrorWrapf(err, dropSQL, nil, "error dropping staging table")
+	}
+
+	return nil
+}
+
+func bulkCopy(ctx context.Context, tx CopyQueryer, table string, columns []string, values [][]any) error {
+	schema, name := splitTableName(table)
+
+	var copySQL string
+	if schema != "" {
+		copySQL = pq.CopyInSchema(schema, name, columns...)
+	} else {
+		copySQL = pq.CopyIn(name, columns...)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, copySQL)
+	if err != nil {
+		return QueryErrorWrapf(err, copySQL, nil, "error preparing copy")
+	}
+	defer stmt.Close()
+
+	for i, row := range values {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return QueryErrorWrapf(err, copySQL, row, "error copying struct %d", i)
+		}
+	}
+
+	// an exec without args flushes the copied data
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return QueryErrorWrapf(err, copySQL, nil, "error completing copy")
+	}
+
+	return nil
+}
+
+// derives column names from the db tags of the given structs and extracts their values
+func copyColumns[T any](structs []T) ([]string, [][]any, error) {
+	mapper := reflectx.NewMapperFunc("db", sqlx.NameMapper)
+
+	t := reflect.TypeOf(structs[0])
+	if t == nil {
+		return nil, nil, errors.New("can't copy nil value at index 0")
+	}
+
+	t = reflectx.Deref(t)
+	if t.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("can't copy values of type %s", t)
+	}
+
+	fields := make([]*reflectx.FieldInfo, 0, t.NumField())
+	for _, fi := range mapper.TypeMap(t).Index {
+		if isCopyColumn(fi) {
+			fields = append(fields, fi)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("type %s has no db tagged fields", t)
+	}
+
+	columns := make([]string, len(fields))
+	for i, fi := range fields {
+		columns[i] = fi.Name
+	}
+
+	values := make([][]any, len(structs))
+	for i, s := range structs {
+		v := reflect.Indirect(reflect.ValueOf(s))
+		if !v.IsValid() {
+			return nil, nil, fmt.Errorf("can't copy nil value at index %d", i)
+		}
+
+		row := make([]any, len(fields))
+		for j, fi := range fields {
+			row[j] = reflectx.FieldByIndexesReadOnly(v, fi.Index).Interface()
+		}
+		values[i] = row
+	}
+
+	return columns, values, nil
+}
+
+// a field is a column if it's a top level field, or within embedded structs, and isn't itself an embedded struct
+func isCopyColumn(fi *reflectx.FieldInfo) bool {
+	if fi.Embedded || fi.Name == "" {
+		return false
+	}
+	for p := fi.Parent; p != nil && p.Parent != nil; p = p.Parent {
+		if !p.Embedded {
+			return false
+		}
+	}
+	return true
+}
+
+// splits a possibly schema qualified table name into its schema and name
+func splitTableName(table string) (string, string) {
+	if schema, name, found := strings.Cut(table, "."); found {
+		return schema, name
+	}
+	return "", table
+}
+
+// quotes a possibly schema qualified table name
+func quoteTableName(table string) string {
+	schema, name := splitTableName(table)
+	if schema != "" {
+		return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+	}
+	return pq.QuoteIdentifier(name)
+}
+
+func quoteIdentifiers(ids []string) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = pq.QuoteIdentifier(id)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
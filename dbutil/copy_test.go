@@ -0,0 +1,98 @@
+package dbutil_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkCopy(t *testing.T) {
+	ctx := context.Background()
+	db := getTestDB()
+
+	defer func() { db.MustExec(`DROP TABLE foo`) }()
+
+	db.MustExec(`CREATE TABLE foo (id serial NOT NULL PRIMARY KEY, uuid VARCHAR(36) NOT NULL UNIQUE, name VARCHAR(3), age INT)`)
+
+	type base struct {
+		UUID string `db:"uuid"`
+	}
+	type foo struct {
+		base
+		Name   string `db:"name"`
+		Age    *int   `db:"age"`
+		Ignore string `db:"-"`
+	}
+
+	age := 64
+	foos := []*foo{
+		{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a01"}, Name: "Bob", Age: &age},
+		{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a02"}, Name: "Jon"},
+	}
+
+	tx := db.MustBegin()
+
+	// noop with zero structs
+	assert.NoError(t, dbutil.BulkCopy(ctx, tx, "foo", []*foo{}))
+
+	assert.NoError(t, dbutil.BulkCopy(ctx, tx, "foo", foos))
+	require.NoError(t, tx.Commit())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM foo`).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Bob' AND age = 64`).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Jon' AND age IS NULL`).Returns(1)
+
+	// error if a value isn't valid
+	tx = db.MustBegin()
+	err := dbutil.BulkCopy(ctx, tx, "foo", []*foo{{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a03"}, Name: "Jonny"}})
+	assert.ErrorContains(t, err, "value too long for type character varying(3)")
+	require.NoError(t, tx.Rollback())
+
+	// error if type isn't a struct
+	tx = db.MustBegin()
+	err = dbutil.BulkCopy(ctx, tx, "foo", []string{"Bob"})
+	assert.EqualError(t, err, "can't copy values of type string")
+	require.NoError(t, tx.Rollback())
+
+	// error if a struct pointer is nil
+	tx = db.MustBegin()
+	err = dbutil.BulkCopy(ctx, tx, "foo", []*foo{foos[0], nil})
+	assert.EqualError(t, err, "can't copy nil value at index 1")
+	require.NoError(t, tx.Rollback())
+
+	// upsert updates existing rows and inserts new ones
+	age = 65
+	foos = []*foo{
+		{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a01"}, Name: "Bob", Age: &age},
+		{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a03"}, Name: "Ann"},
+	}
+
+	tx = db.MustBegin()
+	assert.NoError(t, dbutil.BulkCopyUpsert(ctx, tx, "foo", foos, []string{"uuid"}))
+
+	// can be called again in the same transaction
+	assert.NoError(t, dbutil.BulkCopyUpsert(ctx, tx, "foo", []*foo{{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a02"}, Name: "Jim"}}, []string{"uuid"}))
+	require.NoError(t, tx.Commit())
+
+	assertdb.Query(t, db, `SELECT count(*) FROM foo`).Returns(3)
+	assertdb.Query(t, db, `SELECT name, age FROM foo WHERE uuid = 'e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a01'`).Columns(map[string]any{"name": "Bob", "age": int64(65)})
+	assertdb.Query(t, db, `SELECT name FROM foo WHERE uuid = 'e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a02'`).Returns("Jim")
+	assertdb.Query(t, db, `SELECT name FROM foo WHERE uuid = 'e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a03'`).Returns("Ann")
+
+	tx = db.MustBegin()
+	err = dbutil.BulkCopyUpsert(ctx, tx, "foo", foos, nil)
+	assert.EqualError(t, err, "can't upsert without conflict columns")
+	require.NoError(t, tx.Rollback())
+
+	// table names can be schema qualified
+	tx = db.MustBegin()
+	assert.NoError(t, dbutil.BulkCopy(ctx, tx, "public.foo", []*foo{{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a04"}, Name: "Kim"}}))
+	assert.NoError(t, dbutil.BulkCopyUpsert(ctx, tx, "public.foo", []*foo{{base: base{"e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a04"}, Name: "Kip"}}, []string{"uuid"}))
+	require.NoError(t, tx.Commit())
+
+	assertdb.Query(t, db, `SELECT name FROM foo WHERE uuid = 'e2a2ee16-5f0a-4f0c-9ec4-1c1a6e9c6a04'`).Returns("Kip")
+}
@@ -1,19 +1,154 @@
 package dbutil
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/stringsx"
 )
 
 // IsUniqueViolation returns true if the given error is a violation of unique constraint
 func IsUniqueViolation(err error) bool {
+	return ClassifyError(err) == ErrorUniqueViolation
+}
+
+// ErrorClass is a classification of a database error
+type ErrorClass int
+
+// classes of database errors
+const (
+	ErrorUnknown ErrorClass = iota
+	ErrorUniqueViolation
+	ErrorForeignKeyViolation
+	ErrorNotNullViolation
+	ErrorCheckViolation
+	ErrorSerializationFailure
+	ErrorDeadlock
+	ErrorLockTimeout
+	ErrorQueryCanceled
+	ErrorConnectionLost
+)
+
+func (c ErrorClass) String() string {
+	return [...]string{"unknown", "unique_violation", "foreign_key_violation", "not_null_violation", "check_violation", "serialization_failure", "deadlock", "lock_timeout", "query_canceled", "connection_lost"}[c]
+}
+
+// Retryable returns whether errors of this class are caused by concurrent transactions and so retrying might succeed
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorSerializationFailure || c == ErrorDeadlock
+}
+
+// SQLSTATE codes of classified errors
+var errorClassCodes = map[string]ErrorClass{
+	"23505": ErrorUniqueViolation,
+	"23503": ErrorForeignKeyViolation,
+	"23502": ErrorNotNullViolation,
+	"23514": ErrorCheckViolation,
+	"40001": ErrorSerializationFailure,
+	"40P01": ErrorDeadlock,
+	"55P03": ErrorLockTimeout,
+	"57014": ErrorQueryCanceled,
+	"57P01": ErrorConnectionLost, // admin_shutdown
+	"57P02": ErrorConnectionLost, // crash_shutdown
+	"57P03": ErrorConnectionLost, // cannot_connect_now
+}
+
+// ClassifyError classifies the given error which can be from lib/pq or pgx, and can be wrapped, e.g. in a QueryError
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorUnknown
+	}
+
+	if pgErr := AsPgError(err); pgErr != nil {
+		if class, found := errorClassCodes[pgErr.Code]; found {
+			return class
+		}
+
+		// class 08 is connection exceptions
+		if strings.HasPrefix(pgErr.Code, "08") {
+			return ErrorConnectionLost
+		}
+		return ErrorUnknown
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorQueryCanceled
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return ErrorConnectionLost
+	}
+
+	return ErrorUnknown
+}
+
+// PgError is the details of an error returned by Postgres
+type PgError struct {
+	Code       string // SQLSTATE code
+	Message    string
+	Detail     string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+}
+
+// sqlStater is implemented by errors from both lib/pq and pgx
+type sqlStater interface {
+	SQLState() string
+}
+
+// AsPgError extracts the details of the first error in the given error's chain which came from Postgres, whether it
+// be from lib/pq or pgx, returning nil if there isn't one
+func AsPgError(err error) *PgError {
 	var pqErr *pq.Error
 	if errors.As(err, &pqErr) {
-		return pqErr.Code.Name() == "unique_violation"
+		return &PgError{
+			Code:       string(pqErr.Code),
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Column:     pqErr.Column,
+			Constraint: pqErr.Constraint,
+		}
 	}
-	return false
+
+	// pgx errors are *pgconn.PgError which we read without depending on pgx
+	var stater sqlStater
+	if errors.As(err, &stater) {
+		v := reflect.Indirect(reflect.ValueOf(stater))
+		field := func(name string) string {
+			if v.Kind() == reflect.Struct {
+				if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.String {
+					return f.String()
+				}
+			}
+			return ""
+		}
+
+		return &PgError{
+			Code:       stater.SQLState(),
+			Message:    field("Message"),
+			Detail:     field("Detail"),
+			Schema:     field("SchemaName"),
+			Table:      field("TableName"),
+			Column:     field("ColumnName"),
+			Constraint: field("ConstraintName"),
+		}
+	}
+
+	return nil
 }
 
 // QueryError is an error type for failed SQL queries
@@ -64,3 +199,95 @@ func AsQueryError(err error) *QueryError {
 	errors.As(err, &qerr)
 	return qerr
 }
+
+// Describe formats this error with its query for logging, e.g.
+//
+//	error selecting foo: pq: boom (sql: SELECT * FROM foo WHERE id = $1 AND name = $2, args: [234, "****"])
+func (e *QueryError) Describe(format *QueryFormat) string {
+	return fmt.Sprintf("%s (sql: %s, args: [%s])", e.Error(), format.SQL(e.sql), strings.Join(format.Args(e.sqlArgs), ", "))
+}
+
+// QueryFormat configures how queries are formatted for logging so that they're readable and don't leak sensitive data
+type QueryFormat struct {
+	MaxSQLLength int // SQL longer than this is truncated, zero for no limit
+	MaxArgLength int // args longer than this are truncated, zero for no limit
+	MaxArgs      int // if there are more args than this, e.g. from a bulk query, the rest are omitted, zero for no limit
+
+	// applied to each arg to redact sensitive values
+	Redactor stringsx.Redactor
+
+	// positions of args to replace entirely with the mask, numbered from 1 like placeholders
+	MaskArgs []int
+	Mask     string
+}
+
+// NewQueryFormat creates a new query format with default limits
+func NewQueryFormat() *QueryFormat {
+	return &QueryFormat{MaxSQLLength: 1000, MaxArgLength: 100, MaxArgs: 20, Mask: "****"}
+}
+
+// SQL formats the given SQL
+func (f *QueryFormat) SQL(sql string) string {
+	if f.MaxSQLLength > 0 {
+		return stringsx.TruncateEllipsis(sql, f.MaxSQLLength)
+	}
+	return sql
+}
+
+// Args formats the given query args
+func (f *QueryFormat) Args(args []any) []string {
+	shown := args
+	if f.MaxArgs > 0 && len(args) > f.MaxArgs {
+		shown = args[:f.MaxArgs]
+	}
+
+	formatted := make([]string, len(shown), len(shown)+1)
+	for i, a := range shown {
+		formatted[i] = f.arg(i+1, a)
+	}
+
+	if len(shown) < len(args) {
+		formatted = append(formatted, fmt.Sprintf("... %d more", len(args)-len(shown)))
+	}
+	return formatted
+}
+
+func (f *QueryFormat) arg(pos int, a any) string {
+	for _, p := range f.MaskArgs {
+		if p == pos {
+			return f.Mask
+		}
+	}
+
+	v, isString := formatArg(a)
+	if f.Redactor != nil {
+		v = f.Redactor(v)
+	}
+	if f.MaxArgLength > 0 {
+		v = stringsx.TruncateEllipsis(v, f.MaxArgLength)
+	}
+	if isString {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// formats an arg as it will be sent to the database, returning whether it's a string
+func formatArg(a any) (string, bool) {
+	// convert values like pointers and valuers to what will actually be sent to the database
+	if v, err := driver.DefaultParameterConverter.ConvertValue(a); err == nil {
+		a = v
+	}
+
+	switch v := a.(type) {
+	case nil:
+		return "NULL", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	return fmt.Sprint(a), false
+}
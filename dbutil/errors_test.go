@@ -1,12 +1,18 @@
 package dbutil_test
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/stringsx"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,6 +24,86 @@ func TestIsUniqueViolation(t *testing.T) {
 	assert.False(t, dbutil.IsUniqueViolation(errors.New("boom")))
 }
 
+// mimics the error type of pgx which we don't depend on
+type pgconnError struct {
+	Code           string
+	Message        string
+	Detail         string
+	SchemaName     string
+	TableName      string
+	ColumnName     string
+	ConstraintName string
+}
+
+func (e *pgconnError) Error() string    { return e.Message }
+func (e *pgconnError) SQLState() string { return e.Code }
+
+func TestClassifyError(t *testing.T) {
+	tcs := []struct {
+		err      error
+		expected dbutil.ErrorClass
+	}{
+		{nil, dbutil.ErrorUnknown},
+		{errors.New("boom"), dbutil.ErrorUnknown},
+		{&pq.Error{Code: "22025"}, dbutil.ErrorUnknown},
+		{&pq.Error{Code: "23505"}, dbutil.ErrorUniqueViolation},
+		{&pq.Error{Code: "23503"}, dbutil.ErrorForeignKeyViolation},
+		{&pq.Error{Code: "23502"}, dbutil.ErrorNotNullViolation},
+		{&pq.Error{Code: "23514"}, dbutil.ErrorCheckViolation},
+		{&pq.Error{Code: "40001"}, dbutil.ErrorSerializationFailure},
+		{&pq.Error{Code: "40P01"}, dbutil.ErrorDeadlock},
+		{&pq.Error{Code: "55P03"}, dbutil.ErrorLockTimeout},
+		{&pq.Error{Code: "57014"}, dbutil.ErrorQueryCanceled},
+		{&pq.Error{Code: "57P01"}, dbutil.ErrorConnectionLost},
+		{&pq.Error{Code: "08006"}, dbutil.ErrorConnectionLost},
+		{&pgconnError{Code: "23503"}, dbutil.ErrorForeignKeyViolation},
+		{&pgconnError{Code: "40P01"}, dbutil.ErrorDeadlock},
+		{context.Canceled, dbutil.ErrorQueryCanceled},
+		{context.DeadlineExceeded, dbutil.ErrorQueryCanceled},
+		{driver.ErrBadConn, dbutil.ErrorConnectionLost},
+		{io.ErrUnexpectedEOF, dbutil.ErrorConnectionLost},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, dbutil.ErrorConnectionLost},
+		{fmt.Errorf("wrapped: %w", &pq.Error{Code: "23514"}), dbutil.ErrorCheckViolation},
+		{dbutil.QueryErrorWrapf(&pgconnError{Code: "40001"}, "SELECT", nil, "error selecting"), dbutil.ErrorSerializationFailure},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, dbutil.ClassifyError(tc.err), "class mismatch for error: %v", tc.err)
+	}
+
+	assert.Equal(t, "foreign_key_violation", dbutil.ErrorForeignKeyViolation.String())
+	assert.Equal(t, "connection_lost", dbutil.ErrorConnectionLost.String())
+	assert.True(t, dbutil.ErrorSerializationFailure.Retryable())
+	assert.True(t, dbutil.ErrorDeadlock.Retryable())
+	assert.False(t, dbutil.ErrorUniqueViolation.Retryable())
+}
+
+func TestAsPgError(t *testing.T) {
+	assert.Nil(t, dbutil.AsPgError(nil))
+	assert.Nil(t, dbutil.AsPgError(errors.New("boom")))
+
+	pqErr := &pq.Error{Code: "23503", Message: "insert or update violates foreign key constraint", Detail: "Key (org_id)=(5) is not present", Schema: "public", Table: "contacts", Column: "", Constraint: "contacts_org_id_fkey"}
+
+	assert.Equal(t, &dbutil.PgError{
+		Code:       "23503",
+		Message:    "insert or update violates foreign key constraint",
+		Detail:     "Key (org_id)=(5) is not present",
+		Schema:     "public",
+		Table:      "contacts",
+		Constraint: "contacts_org_id_fkey",
+	}, dbutil.AsPgError(dbutil.QueryErrorWrapf(pqErr, "INSERT", nil, "error inserting")))
+
+	pgxErr := &pgconnError{Code: "23502", Message: "null value in column violates not-null constraint", SchemaName: "public", TableName: "contacts", ColumnName: "name"}
+
+	assert.Equal(t, &dbutil.PgError{
+		Code:    "23502",
+		Message: "null value in column violates not-null constraint",
+		Schema:  "public",
+		Table:   "contacts",
+		Column:  "name",
+	}, dbutil.AsPgError(fmt.Errorf("wrapped: %w", pgxErr)))
+}
+
 func TestQueryError(t *testing.T) {
 	qerr := dbutil.QueryErrorf("SELECT * FROM foo WHERE id = $1", []any{234}, "error selecting foo %d", 234)
 	assert.Error(t, qerr)
@@ -53,3 +139,35 @@ func TestQueryError(t *testing.T) {
 	// wrapping a nil error returns nil
 	assert.Nil(t, dbutil.QueryErrorWrapf(nil, "SELECT", nil, "ooh"))
 }
+
+func TestQueryErrorDescribe(t *testing.T) {
+	name := "Bob"
+	qerr := dbutil.AsQueryError(dbutil.QueryErrorWrapf(
+		&pq.Error{Message: "boom"},
+		"INSERT INTO foo (id, name, phone, created_on, data, notes) VALUES($1, $2, $3, $4, $5, $6)",
+		[]any{234, &name, "+593979123456", time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), []byte(`{"secret": "sesame"}`), nil},
+		"error inserting foo",
+	))
+
+	// with defaults
+	assert.Equal(t, `error inserting foo: pq: boom (sql: INSERT INTO foo (id, name, phone, created_on, data, notes) VALUES($1, $2, $3, $4, $5, $6), args: [234, "Bob", "+593979123456", "2024-05-01T12:30:00Z", "{\"secret\": \"sesame\"}", NULL])`, qerr.Describe(dbutil.NewQueryFormat()))
+
+	// with truncation, redaction and masking
+	format := &dbutil.QueryFormat{
+		MaxSQLLength: 30,
+		MaxArgLength: 10,
+		Redactor:     stringsx.NewRedactor("****", "sesame"),
+		MaskArgs:     []int{3},
+		Mask:         "xxx",
+	}
+	assert.Equal(t, `error inserting foo: pq: boom (sql: INSERT INTO foo (id, name, ..., args: [234, "Bob", xxx, "2024-05...", "{\"secre...", NULL])`, qerr.Describe(format))
+	assert.Equal(t, []string{`"{\"secret\": \"****\"}"`}, (&dbutil.QueryFormat{Redactor: format.Redactor}).Args([]any{[]byte(`{"secret": "sesame"}`)}))
+
+	// huge bulk arg lists are rendered compactly
+	args := make([]any, 10000)
+	for i := range args {
+		args[i] = i
+	}
+	assert.Equal(t, []string{"0", "1", "2", "... 9997 more"}, (&dbutil.QueryFormat{MaxArgs: 3}).Args(args))
+	assert.Len(t, dbutil.NewQueryFormat().Args(args), 21)
+}
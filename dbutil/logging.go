@@ -0,0 +1,151 @@
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/analytics"
+)
+
+const defaultSlowThreshold = time.Second
+
+// Queryer is the DB/TX functionality which can be wrapped by a LoggingQueryer
+type Queryer interface {
+	BulkQueryer
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowxContext(ctx context.Context, query string, args ...any) *sqlx.Row
+	GetContext(ctx context.Context, dest any, query string, args ...any) error
+	SelectContext(ctx context.Context, dest any, query string, args ...any) error
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// LoggingQueryerOptions configures a logging queryer
+type LoggingQueryerOptions struct {
+	// statements taking at least this long are logged as warnings, and others as debug
+	SlowThreshold time.Duration
+
+	// logger to use, which if nil means the default logger is used
+	Logger *slog.Logger
+
+	// how SQL and args are formatted for logs, so that they're truncated and secrets aren't written to logs, which if nil
+	// means the default format is used
+	Format *QueryFormat
+
+	// if set, the duration of each statement is recorded as the gauge <prefix>.query_time in milliseconds
+	AnalyticsPrefix string
+
+	// extracts attributes from the context of each statement to include in its log entry, e.g. a request ID
+	ContextAttrs func(ctx context.Context) []slog.Attr
+}
+
+// NewLoggingQueryerOptions creates new logging queryer options with the default slow threshold
+func NewLoggingQueryerOptions() *LoggingQueryerOptions {
+	return &LoggingQueryerOptions{SlowThreshold: defaultSlowThreshold}
+}
+
+// returns a copy of these options with defaults for any unset values
+func (o *LoggingQueryerOptions) withDefaults() *LoggingQueryerOptions {
+	c := *o
+	if c.SlowThreshold <= 0 {
+		c.SlowThreshold = defaultSlowThreshold
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	if c.Format == nil {
+		c.Format = NewQueryFormat()
+	}
+	return &c
+}
+
+// LoggingQueryer wraps a DB or TX to time and log every statement. Note that for queries returning rows, the time is
+// until the rows are returned, not until they've been read. Prepared statements aren't timed. To log the statements of
+// a transaction, the TX should be wrapped as well.
+type LoggingQueryer struct {
+	db      Queryer
+	options *LoggingQueryerOptions
+}
+
+// NewLoggingQueryer creates a new logging queryer
+func NewLoggingQueryer(db Queryer, options *LoggingQueryerOptions) *LoggingQueryer {
+	return &LoggingQueryer{db: db, options: options.withDefaults()}
+}
+
+func (q *LoggingQueryer) Rebind(query string) string {
+	return q.db.Rebind(query)
+}
+
+func (q *LoggingQueryer) QueryxContext(ctx context.Context, query string, args ...any) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := q.db.QueryxContext(ctx, query, args...)
+	q.record(ctx, query, args, time.Since(start), err)
+	return rows, err
+}
+
+func (q *LoggingQueryer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	res, err := q.db.ExecContext(ctx, query, args...)
+	q.record(ctx, query, args, time.Since(start), err)
+	return res, err
+}
+
+func (q *LoggingQueryer) QueryRowxContext(ctx context.Context, query string, args ...any) *sqlx.Row {
+	start := time.Now()
+	row := q.db.QueryRowxContext(ctx, query, args...)
+	q.record(ctx, query, args, time.Since(start), row.Err())
+	return row
+}
+
+func (q *LoggingQueryer) GetContext(ctx context.Context, dest any, query string, args ...any) error {
+	start := time.Now()
+	err := q.db.GetContext(ctx, dest, query, args...)
+	q.record(ctx, query, args, time.Since(start), err)
+	return err
+}
+
+func (q *LoggingQueryer) SelectContext(ctx context.Context, dest any, query string, args ...any) error {
+	start := time.Now()
+	err := q.db.SelectContext(ctx, dest, query, args...)
+	q.record(ctx, query, args, time.Since(start), err)
+	return err
+}
+
+func (q *LoggingQueryer) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return q.db.PrepareContext(ctx, query)
+}
+
+// records the duration of a statement and logs it
+func (q *LoggingQueryer) record(ctx context.Context, query string, args []any, elapsed time.Duration, err error) {
+	if q.options.AnalyticsPrefix != "" {
+		analytics.Gauge(q.options.AnalyticsPrefix+".query_time", float64(elapsed)/float64(time.Millisecond))
+	}
+
+	level, msg := slog.LevelDebug, "query"
+	if elapsed >= q.options.SlowThreshold {
+		level, msg = slog.LevelWarn, "slow query"
+	}
+
+	if !q.options.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("sql", q.options.Format.SQL(query)),
+		slog.Any("args", q.options.Format.Args(args)),
+		slog.Int64("elapsed_ms", elapsed.Milliseconds()),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	if q.options.ContextAttrs != nil {
+		attrs = append(attrs, q.options.ContextAttrs(ctx)...)
+	}
+
+	q.options.Logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+var _ Queryer = (*LoggingQueryer)(nil)
+var _ CopyQueryer = (*LoggingQueryer)(nil)
@@ -0,0 +1,121 @@
+package dbutil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/analytics"
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/stringsx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ dbutil.Queryer = (*sqlx.DB)(nil)
+var _ dbutil.Queryer = (*sqlx.Tx)(nil)
+
+type requestIDKey struct{}
+
+func TestQueryerLogging(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "abc123")
+	db := getTestDB()
+
+	defer func() { db.MustExec(`DROP TABLE foo`) }()
+
+	db.MustExec(`CREATE TABLE foo (id serial NOT NULL PRIMARY KEY, name VARCHAR(3), secret VARCHAR(10))`)
+
+	mock := analytics.NewMock()
+	analytics.RegisterBackend(mock)
+	defer analytics.RemoveBackend(mock)
+
+	out := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	readLogs := func() []map[string]any {
+		var logs []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var l map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &l))
+			logs = append(logs, l)
+		}
+		out.Reset()
+		return logs
+	}
+
+	q := dbutil.NewLoggingQueryer(db, &dbutil.LoggingQueryerOptions{
+		SlowThreshold:   50 * time.Millisecond,
+		Logger:          logger,
+		Format:          &dbutil.QueryFormat{MaxArgs: 2, Redactor: stringsx.NewRedactor("****", "sesame")},
+		AnalyticsPrefix: "db",
+		ContextAttrs: func(ctx context.Context) []slog.Attr {
+			return []slog.Attr{slog.Any("request_id", ctx.Value(requestIDKey{}))}
+		},
+	})
+
+	name := "Bob"
+	_, err := q.ExecContext(ctx, `INSERT INTO foo (name, secret) VALUES($1, $2)`, &name, "sesame")
+	assert.NoError(t, err)
+
+	var count int
+	err = q.GetContext(ctx, &count, `SELECT count(*) FROM foo`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// errors are included in logs
+	_, err = q.ExecContext(ctx, `INSERT INTO foo (name) VALUES($1)`, "Jonny")
+	assert.EqualError(t, err, "pq: value too long for type character varying(3)")
+
+	logs := readLogs()
+	if assert.Len(t, logs, 3) {
+		assert.Equal(t, "DEBUG", logs[0]["level"])
+		assert.Equal(t, "query", logs[0]["msg"])
+		assert.Equal(t, `INSERT INTO foo (name, secret) VALUES($1, $2)`, logs[0]["sql"])
+		assert.Equal(t, []any{`"Bob"`, `"****"`}, logs[0]["args"])
+		assert.Equal(t, "abc123", logs[0]["request_id"])
+		assert.NotContains(t, logs[0], "error")
+
+		assert.Equal(t, `SELECT count(*) FROM foo`, logs[1]["sql"])
+		assert.Equal(t, []any{}, logs[1]["args"])
+
+		assert.Equal(t, "pq: value too long for type character varying(3)", logs[2]["error"])
+	}
+
+	assert.Len(t, mock.Gauges["db.query_time"], 3)
+
+	// slow queries are logged as warnings
+	var slept string
+	err = q.QueryRowxContext(ctx, `SELECT pg_sleep(0.1)::text`).Scan(&slept)
+	assert.NoError(t, err)
+
+	logs = readLogs()
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "WARN", logs[0]["level"])
+		assert.Equal(t, "slow query", logs[0]["msg"])
+		assert.GreaterOrEqual(t, logs[0]["elapsed_ms"], float64(100))
+	}
+
+	// wrapped queryer can be used for bulk queries
+	type foo struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	foos := []*foo{{Name: "Jim"}, {Name: "Ann"}, {Name: "Cat"}}
+	err = dbutil.BulkQuery(ctx, q, `INSERT INTO foo (name) VALUES(:name) RETURNING id`, foos)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, foos[0].ID) // failed insert used id 2
+	assert.Equal(t, 4, foos[1].ID)
+	assert.Equal(t, 5, foos[2].ID)
+
+	// and args beyond the format's limit are omitted from logs
+	logs = readLogs()
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, `INSERT INTO foo (name) VALUES($1),($2),($3) RETURNING id`, logs[0]["sql"])
+		assert.Equal(t, []any{`"Jim"`, `"Ann"`, "... 1 more"}, logs[0]["args"])
+	}
+}
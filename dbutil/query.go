@@ -0,0 +1,105 @@
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RowsQueryer is the DB/TX functionality needed to query rows
+type RowsQueryer interface {
+	QueryxContext(ctx context.Context, query string, args ...any) (*sqlx.Rows, error)
+}
+
+// QueryRows runs the given query and returns an iterator over the rows scanned as values of T, which can be a struct
+// with db tagged fields or a single column value. A failure is yielded as an error, after which iteration stops. Rows
+// are closed when iteration stops, even if the caller stops it early.
+func QueryRows[T any](ctx context.Context, db RowsQueryer, query string, args ...any) func(yield func(T, error) bool) {
+	return queryRows(ctx, db, query, args, scanValue[T])
+}
+
+// QueryAll runs the given query and returns all rows scanned as values of T, which can be a struct with db tagged fields
+// or a single column value.
+func QueryAll[T any](ctx context.Context, db RowsQueryer, query string, args ...any) ([]T, error) {
+	return collectRows(queryRows(ctx, db, query, args, scanValue[T]))
+}
+
+// QueryOne runs the given query and returns the first row scanned as a value of T, which can be a struct with db tagged
+// fields or a single column value. If there are no rows, the error wraps sql.ErrNoRows.
+func QueryOne[T any](ctx context.Context, db RowsQueryer, query string, args ...any) (T, error) {
+	var v T
+	var err error = QueryErrorWrapf(sql.ErrNoRows, query, args, "error querying row")
+
+	queryRows(ctx, db, query, args, scanValue[T])(func(r T, e error) bool {
+		v, err = r, e
+		return false
+	})
+
+	return v, err
+}
+
+// QueryJSON runs the given query and returns all rows as a single column containing JSON unmarshalled into values of T.
+func QueryJSON[T any](ctx context.Context, db RowsQueryer, query string, args ...any) ([]T, error) {
+	return collectRows(queryRows(ctx, db, query, args, func(rows *sqlx.Rows, v *T) error { return ScanJSON(rows, v) }))
+}
+
+func queryRows[T any](ctx context.Context, db RowsQueryer, query string, args []any, scan func(*sqlx.Rows, *T) error) func(yield func(T, error) bool) {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		rows, err := db.QueryxContext(ctx, query, args...)
+		if err != nil {
+			yield(zero, QueryErrorWrapf(err, query, args, "error querying rows"))
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var v T
+			if err := scan(rows, &v); err != nil {
+				yield(zero, QueryErrorWrapf(err, query, args, "error scanning row"))
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(zero, QueryErrorWrapf(err, query, args, "error during row iteration"))
+		}
+	}
+}
+
+func collectRows[T any](seq func(yield func(T, error) bool)) ([]T, error) {
+	vs := make([]T, 0)
+	var err error
+
+	seq(func(v T, e error) bool {
+		if e != nil {
+			err = e
+			return false
+		}
+		vs = append(vs, v)
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// scans a row into a struct if T is a struct with mapped fields, otherwise as a single column value
+func scanValue[T any](rows *sqlx.Rows, v *T) error {
+	t := reflect.TypeOf(v).Elem()
+
+	if t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(scannerType) && len(rows.Mapper.TypeMap(t).Index) > 0 {
+		return rows.StructScan(v)
+	}
+	return rows.Scan(v)
+}
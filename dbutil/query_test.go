@@ -0,0 +1,104 @@
+package dbutil_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryHelpers(t *testing.T) {
+	ctx := context.Background()
+	db := getTestDB()
+
+	defer func() { db.MustExec(`DROP TABLE foo`) }()
+
+	db.MustExec(`CREATE TABLE foo (id serial NOT NULL PRIMARY KEY, name VARCHAR(10), created_on TIMESTAMPTZ NOT NULL)`)
+	db.MustExec(`INSERT INTO foo (name, created_on) VALUES('Bob', '2024-05-01T12:30:00Z'), ('Cathy', '2024-05-02T12:30:00Z'), ('George', '2024-05-03T12:30:00Z')`)
+
+	type foo struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+
+	// rows can be scanned into structs
+	foos, err := dbutil.QueryAll[foo](ctx, db, `SELECT id, name FROM foo WHERE id > $1 ORDER BY id`, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []foo{{2, "Cathy"}, {3, "George"}}, foos)
+
+	// or single column values
+	names, err := dbutil.QueryAll[string](ctx, db, `SELECT name FROM foo ORDER BY id`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bob", "Cathy", "George"}, names)
+
+	times, err := dbutil.QueryAll[time.Time](ctx, db, `SELECT created_on FROM foo ORDER BY id LIMIT 1`)
+	assert.NoError(t, err)
+	if assert.Len(t, times, 1) {
+		assert.True(t, times[0].Equal(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)))
+	}
+
+	// no rows gives an empty slice
+	names, err = dbutil.QueryAll[string](ctx, db, `SELECT name FROM foo WHERE id > 10`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, names)
+
+	// errors are wrapped in query errors
+	_, err = dbutil.QueryAll[string](ctx, db, `SELECT nme FROM foo`)
+	assert.EqualError(t, err, `error querying rows: pq: column "nme" does not exist`)
+	assert.NotNil(t, dbutil.AsQueryError(err))
+
+	_, err = dbutil.QueryAll[int](ctx, db, `SELECT name FROM foo`)
+	assert.ErrorContains(t, err, "error scanning row: sql: Scan error on column index 0")
+
+	// single rows
+	f, err := dbutil.QueryOne[foo](ctx, db, `SELECT id, name FROM foo WHERE name = $1`, "Cathy")
+	assert.NoError(t, err)
+	assert.Equal(t, foo{2, "Cathy"}, f)
+
+	count, err := dbutil.QueryOne[int](ctx, db, `SELECT count(*) FROM foo`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	_, err = dbutil.QueryOne[foo](ctx, db, `SELECT id, name FROM foo WHERE name = $1`, "Zed")
+	assert.EqualError(t, err, "error querying row: sql: no rows in result set")
+	assert.True(t, errors.Is(err, sql.ErrNoRows))
+
+	// JSON rows
+	type fooJSON struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	fjs, err := dbutil.QueryJSON[fooJSON](ctx, db, `SELECT row_to_json(f) FROM (SELECT id, name FROM foo ORDER BY id LIMIT 2) f`)
+	assert.NoError(t, err)
+	assert.Equal(t, []fooJSON{{1, "Bob"}, {2, "Cathy"}}, fjs)
+
+	_, err = dbutil.QueryJSON[fooJSON](ctx, db, `SELECT name FROM foo`)
+	assert.ErrorContains(t, err, "error scanning row: error unmarshalling row JSON")
+
+	// iteration can be stopped early
+	names = nil
+	dbutil.QueryRows[string](ctx, db, `SELECT name FROM foo ORDER BY id`)(func(name string, err error) bool {
+		assert.NoError(t, err)
+		names = append(names, name)
+		return len(names) < 2
+	})
+	assert.Equal(t, []string{"Bob", "Cathy"}, names)
+
+	// errors are yielded once
+	var errs []error
+	dbutil.QueryRows[string](ctx, db, `SELECT nme FROM foo`)(func(name string, err error) bool {
+		errs = append(errs, err)
+		return true
+	})
+	if assert.Len(t, errs, 1) {
+		assert.EqualError(t, errs[0], `error querying rows: pq: column "nme" does not exist`)
+	}
+
+	// rows were closed so all connections are idle
+	assert.Equal(t, 0, db.Stats().InUse)
+}
@@ -0,0 +1,127 @@
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Transactor is the DB functionality needed to run transactions
+type Transactor interface {
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+}
+
+// TransactOptions configures how Transact runs a transaction
+type TransactOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+
+	// delays before each retry of a transaction which failed with a retryable error, e.g. a serialization failure
+	Backoffs []time.Duration
+}
+
+// NewTransactOptions creates new transaction options with the default isolation level and retry backoffs
+func NewTransactOptions() *TransactOptions {
+	return &TransactOptions{
+		Backoffs: []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 250 * time.Millisecond},
+	}
+}
+
+// key for the transaction of a Transact call stored in the context passed to its callback
+type transactKey struct{}
+
+type transaction struct {
+	db         Transactor
+	tx         *sqlx.Tx
+	savepoints int
+}
+
+// Transact runs the given function in a transaction which is committed if it returns nil, and rolled back if it returns
+// an error or panics. If it fails with a retryable error like a serialization failure or deadlock, the whole transaction
+// is retried after each of the backoffs. If called with the context passed to the function of an outer Transact call on
+// the same DB, it runs in a savepoint of the outer transaction instead, and isn't retried itself. All errors are returned
+// as a QueryError which wraps the original error, and errors from the function keep the query of any QueryError they
+// wrap.
+func Transact(ctx context.Context, db Transactor, opts *TransactOptions, fn func(ctx context.Context, tx *sqlx.Tx) error) error {
+	if opts == nil {
+		opts = NewTransactOptions()
+	}
+
+	if outer, ok := ctx.Value(transactKey{}).(*transaction); ok && outer.db == db {
+		return transactSavepoint(ctx, outer, fn)
+	}
+
+	for retry := 0; ; retry++ {
+		err := transact(ctx, db, opts, fn)
+
+		if err == nil || !ClassifyError(err).Retryable() || retry >= len(opts.Backoffs) {
+			return err
+		}
+
+		select {
+		case <-time.After(opts.Backoffs[retry]):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func transact(ctx context.Context, db Transactor, opts *TransactOptions, fn func(context.Context, *sqlx.Tx) error) (err error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return QueryErrorWrapf(err, "BEGIN", nil, "error beginning transaction")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, transactKey{}, &transaction{db: db, tx: tx}), tx); err != nil {
+		tx.Rollback()
+		return wrapFuncError(err, "error in transaction")
+	}
+
+	return QueryErrorWrapf(tx.Commit(), "COMMIT", nil, "error committing transaction")
+}
+
+func transactSavepoint(ctx context.Context, outer *transaction, fn func(context.Context, *sqlx.Tx) error) error {
+	outer.savepoints++
+	name := fmt.Sprintf("sp_%d", outer.savepoints)
+
+	if _, err := outer.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return QueryErrorWrapf(err, "SAVEPOINT "+name, nil, "error creating savepoint")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			outer.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(r)
+		}
+	}()
+
+	if err := fn(ctx, outer.tx); err != nil {
+		if _, rerr := outer.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+			return QueryErrorWrapf(rerr, "ROLLBACK TO SAVEPOINT "+name, nil, "error rolling back savepoint")
+		}
+		return wrapFuncError(err, "error in savepoint")
+	}
+
+	_, err := outer.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return QueryErrorWrapf(err, "RELEASE SAVEPOINT "+name, nil, "error releasing savepoint")
+}
+
+// wraps an error from a transaction function as a query error, keeping the query of any query error it wraps
+func wrapFuncError(err error, message string) error {
+	var sql string
+	var sqlArgs []any
+	if qerr := AsQueryError(err); qerr != nil {
+		sql, sqlArgs = qerr.Query()
+	}
+	return QueryErrorWrapf(err, sql, sqlArgs, message)
+}
@@ -0,0 +1,114 @@
+package dbutil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransact(t *testing.T) {
+	ctx := context.Background()
+	db := getTestDB()
+
+	defer func() { db.MustExec(`DROP TABLE foo`) }()
+
+	db.MustExec(`CREATE TABLE foo (id serial NOT NULL PRIMARY KEY, name VARCHAR(3))`)
+
+	insert := func(name string) func(context.Context, *sqlx.Tx) error {
+		return func(ctx context.Context, tx *sqlx.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO foo (name) VALUES($1)`, name)
+			return err
+		}
+	}
+
+	// committed if function succeeds
+	err := dbutil.Transact(ctx, db, nil, insert("Bob"))
+	assert.NoError(t, err)
+	assertdb.Query(t, db, `SELECT name FROM foo`).Returns("Bob")
+
+	// rolled back if function errors
+	err = dbutil.Transact(ctx, db, nil, func(ctx context.Context, tx *sqlx.Tx) error {
+		insert("Jim")(ctx, tx)
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "error in transaction: boom")
+	assert.NotNil(t, dbutil.AsQueryError(err))
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Jim'`).Returns(0)
+
+	// rolled back if function panics
+	assert.PanicsWithValue(t, "boom", func() {
+		dbutil.Transact(ctx, db, nil, func(ctx context.Context, tx *sqlx.Tx) error {
+			insert("Jim")(ctx, tx)
+			panic("boom")
+		})
+	})
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Jim'`).Returns(0)
+
+	// retryable errors cause the whole transaction to be retried
+	opts := &dbutil.TransactOptions{Backoffs: []time.Duration{time.Millisecond, time.Millisecond}}
+	attempts := 0
+	err = dbutil.Transact(ctx, db, opts, func(ctx context.Context, tx *sqlx.Tx) error {
+		attempts++
+		insert("Ann")(ctx, tx)
+		if attempts < 3 {
+			return &pq.Error{Code: "40001", Message: "could not serialize access"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Ann'`).Returns(1)
+
+	// until we run out of backoffs
+	attempts = 0
+	err = dbutil.Transact(ctx, db, opts, func(ctx context.Context, tx *sqlx.Tx) error {
+		attempts++
+		return &pq.Error{Code: "40P01", Message: "deadlock detected"}
+	})
+	assert.EqualError(t, err, "error in transaction: pq: deadlock detected")
+	assert.Equal(t, dbutil.ErrorDeadlock, dbutil.ClassifyError(err))
+	assert.Equal(t, 3, attempts)
+
+	// other errors aren't retried
+	attempts = 0
+	err = dbutil.Transact(ctx, db, opts, func(ctx context.Context, tx *sqlx.Tx) error {
+		attempts++
+		return insert("Jonny")(ctx, tx)
+	})
+	assert.EqualError(t, err, "error in transaction: pq: value too long for type character varying(3)")
+	assert.Equal(t, 1, attempts)
+
+	// nested calls use savepoints so can be rolled back without rolling back the outer transaction
+	err = dbutil.Transact(ctx, db, nil, func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := insert("Cat")(ctx, tx); err != nil {
+			return err
+		}
+
+		err := dbutil.Transact(ctx, db, nil, func(ctx context.Context, tx *sqlx.Tx) error {
+			insert("Dan")(ctx, tx)
+			return errors.New("boom")
+		})
+		assert.EqualError(t, err, "error in savepoint: boom")
+
+		// transaction is still usable
+		return dbutil.Transact(ctx, db, nil, insert("Eve"))
+	})
+	assert.NoError(t, err)
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name IN ('Cat', 'Eve')`).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM foo WHERE name = 'Dan'`).Returns(0)
+
+	// error if we can't begin a transaction
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err = dbutil.Transact(cancelled, db, nil, insert("Fay"))
+	assert.EqualError(t, err, "error beginning transaction: context canceled")
+	assert.NotNil(t, dbutil.AsQueryError(err))
+}
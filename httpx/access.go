@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -40,20 +41,40 @@ func (c *AccessConfig) Allow(request *http.Request) (bool, error) {
 
 	// if any of the host's addresses appear in the disallowed list, deny the request
 	for _, addr := range addrs {
-		for _, disallowed := range c.DisallowedIPs {
-			if addr.IP.Equal(disallowed) {
-				return false, nil
-			}
-		}
-		for _, disallowed := range c.DisallowedNets {
-			if disallowed.Contains(addr.IP) {
-				return false, nil
-			}
+		if !c.allowIP(addr.IP) {
+			return false, nil
 		}
 	}
 	return true, nil
 }
 
+func (c *AccessConfig) allowIP(ip net.IP) bool {
+	for _, disallowed := range c.DisallowedIPs {
+		if ip.Equal(disallowed) {
+			return false
+		}
+	}
+	for _, disallowed := range c.DisallowedNets {
+		if disallowed.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks an address that a client is about to connect to
+func (c *AccessConfig) control(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && !c.allowIP(ip) {
+		return ErrAccessConfig
+	}
+	return nil
+}
+
 // ParseNetworks parses a list of IPs and IP networks (written in CIDR notation)
 func ParseNetworks(addrs ...string) ([]net.IP, []*net.IPNet, error) {
 	ips := make([]net.IP, 0, len(addrs))
@@ -0,0 +1,388 @@
+package httpx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/cache"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/storage"
+)
+
+// CacheHitHeader is the header added to responses which were served from a cache, and removed from responses which
+// weren't so that it can't be set by remote servers
+const CacheHitHeader = "X-From-Cache"
+
+// CacheStore is something that can store serialized cached responses
+type CacheStore interface {
+	// Get returns the entry with the given key or nil if there is no such entry
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set saves the entry with the given key
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// CachingRequestor is a requestor which caches GET responses according to their HTTP cache headers, i.e. it honors
+// Cache-Control, Expires, ETag, Last-Modified and Vary, and revalidates stale responses with conditional requests. As
+// the cache is shared between callers, requests with credentials are never cached.
+type CachingRequestor struct {
+	next         Requestor
+	store        CacheStore
+	maxBodyBytes int
+}
+
+// NewCachingRequestor creates a new caching requestor which makes actual requests with `next` and stores responses in
+// `store`. Responses with bodies larger than `maxBodyBytes` (if greater than zero) are never cached.
+func NewCachingRequestor(next Requestor, store CacheStore, maxBodyBytes int) *CachingRequestor {
+	return &CachingRequestor{next: next, store: store, maxBodyBytes: maxBodyBytes}
+}
+
+// Do makes the given request, returning a cached response if there is a fresh one
+func (r *CachingRequestor) Do(client *http.Client, request *http.Request) (*http.Response, error) {
+	reqCC := parseCacheControl(request.Header)
+
+	if request.Method != http.MethodGet || reqCC.has("no-store") || hasCredentials(request) {
+		return r.next.Do(client, request)
+	}
+
+	ctx := request.Context()
+	key := request.Method + " " + request.URL.String()
+
+	// errors from the store are treated as misses as the cache is only ever an optimization
+	entry := r.load(ctx, key, request)
+	if entry == nil {
+		return r.fetch(ctx, client, request, key)
+	}
+
+	cached, err := entry.toResponse(request)
+	if err != nil {
+		return r.fetch(ctx, client, request, key)
+	}
+
+	if !reqCC.has("no-cache") && entry.isFresh(cached.Header) {
+		return markCacheHit(cached), nil
+	}
+
+	return r.revalidate(ctx, client, request, key, cached)
+}
+
+// whether the request has credentials, in which case a shared cache can't serve it a response that was fetched for
+// another caller (RFC 9111 section 3.5)
+func hasCredentials(request *http.Request) bool {
+	return request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != ""
+}
+
+// body of a response served from the cache, which lets us identify cache hits without trusting response headers
+type cachedBody struct {
+	io.ReadCloser
+}
+
+func markCacheHit(response *http.Response) *http.Response {
+	response.Header.Set(CacheHitHeader, "1")
+	response.Body = &cachedBody{response.Body}
+	return response
+}
+
+// whether the given response was served from a caching requestor
+func isCacheHit(response *http.Response) bool {
+	if response == nil {
+		return false
+	}
+	_, isCached := response.Body.(*cachedBody)
+	return isCached
+}
+
+// makes the request and caches the response if possible
+func (r *CachingRequestor) fetch(ctx context.Context, client *http.Client, request *http.Request, key string) (*http.Response, error) {
+	response, err := r.next.Do(client, request)
+	if response != nil {
+		response.Header.Del(CacheHitHeader)
+	}
+	if err != nil || !isCacheable(response) {
+		return response, err
+	}
+
+	r.save(ctx, key, request, response)
+
+	return response, nil
+}
+
+// makes a conditional request for a stale response, returning the cached response if it's still valid
+func (r *CachingRequestor) revalidate(ctx context.Context, client *http.Client, request *http.Request, key string, cached *http.Response) (*http.Response, error) {
+	etag := cached.Header.Get("ETag")
+	lastModified := cached.Header.Get("Last-Modified")
+
+	// no validators so can't do a conditional request
+	if etag == "" && lastModified == "" {
+		cached.Body.Close()
+		return r.fetch(ctx, client, request, key)
+	}
+
+	conditional := request.Clone(ctx)
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	response, err := r.next.Do(client, conditional)
+	if response != nil {
+		response.Header.Del(CacheHitHeader)
+	}
+	if err != nil || response.StatusCode != http.StatusNotModified {
+		cached.Body.Close()
+
+		if err == nil && isCacheable(response) {
+			r.save(ctx, key, request, response)
+		}
+		return response, err
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	// update the cached response with the headers from the 304 response
+	for k, vs := range response.Header {
+		if k != "Content-Length" {
+			cached.Header[k] = vs
+		}
+	}
+
+	r.save(ctx, key, request, cached)
+
+	return markCacheHit(cached), nil
+}
+
+// tries to load the entry for the given request
+func (r *CachingRequestor) load(ctx context.Context, key string, request *http.Request) *cacheEntry {
+	data, err := r.store.Get(ctx, key)
+	if err != nil || data == nil {
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	if err := jsonx.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+
+	// check the request matches the request headers the response varies on
+	for h, v := range entry.Vary {
+		if request.Header.Get(h) != v {
+			return nil
+		}
+	}
+
+	return entry
+}
+
+// tries to save the given response, leaving its body readable by the caller
+func (r *CachingRequestor) save(ctx context.Context, key string, request *http.Request, response *http.Response) {
+	var reader io.Reader = response.Body
+	if r.maxBodyBytes > 0 {
+		reader = io.LimitReader(response.Body, int64(r.maxBodyBytes)+1)
+	}
+
+	body, err := io.ReadAll(reader)
+
+	// if we couldn't read the complete body or it's too big, give the caller back what we read plus the rest
+	if err != nil || (r.maxBodyBytes > 0 && len(body) > r.maxBodyBytes) {
+		response.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(body), response.Body), Closer: response.Body}
+		return
+	}
+
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	dump, err := httputil.DumpResponse(response, true)
+	if err != nil {
+		return
+	}
+
+	entry := &cacheEntry{StoredOn: dates.Now(), Response: dump}
+
+	for _, h := range varyHeaders(response.Header) {
+		if entry.Vary == nil {
+			entry.Vary = make(map[string]string)
+		}
+		entry.Vary[h] = request.Header.Get(h)
+	}
+
+	data, err := jsonx.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	r.store.Set(ctx, key, data)
+}
+
+var _ Requestor = (*CachingRequestor)(nil)
+
+// a response body which replays already read bytes but closes the original body
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+type cacheEntry struct {
+	StoredOn time.Time         `json:"stored_on"`
+	Vary     map[string]string `json:"vary,omitempty"`
+	Response []byte            `json:"response"`
+}
+
+func (e *cacheEntry) toResponse(request *http.Request) (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(e.Response)), request)
+}
+
+// determines whether the entry, with the given (possibly updated) headers, is still fresh
+func (e *cacheEntry) isFresh(header http.Header) bool {
+	age := dates.Since(e.StoredOn)
+	if a, err := strconv.Atoi(header.Get("Age")); err == nil && a > 0 {
+		age += time.Duration(a) * time.Second
+	}
+
+	return freshnessLifetime(header, e.StoredOn) > age
+}
+
+// determines how long a response with the given headers is fresh for
+func freshnessLifetime(header http.Header, storedOn time.Time) time.Duration {
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return 0
+	}
+
+	if maxAge, ok := cc["max-age"]; ok {
+		secs, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresOn, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = storedOn
+		}
+		return expiresOn.Sub(date)
+	}
+
+	return 0
+}
+
+// determines whether the given response can be stored
+func isCacheable(response *http.Response) bool {
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+
+	if parseCacheControl(response.Header).has("no-store") {
+		return false
+	}
+
+	for _, h := range varyHeaders(response.Header) {
+		if h == "*" {
+			return false
+		}
+	}
+
+	// only worth storing if it's fresh for some time or can be revalidated
+	_, hasMaxAge := parseCacheControl(response.Header)["max-age"]
+	h := response.Header
+	return hasMaxAge || h.Get("Expires") != "" || h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+func varyHeaders(header http.Header) []string {
+	var headers []string
+	for _, v := range header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers = append(headers, http.CanonicalHeaderKey(h))
+			}
+		}
+	}
+	return headers
+}
+
+type cacheControl map[string]string
+
+func (c cacheControl) has(directive string) bool {
+	_, ok := c[directive]
+	return ok
+}
+
+// parses the Cache-Control directives in the given headers
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+type localCacheStore struct {
+	cache *cache.Local[string, []byte]
+}
+
+// NewLocalCacheStore creates a new cache store which keeps entries in the given in-memory cache. Note that the
+// lifetime of entries in this cache should be longer than the freshness of responses for them to be useful.
+func NewLocalCacheStore(c *cache.Local[string, []byte]) CacheStore {
+	return &localCacheStore{cache: c}
+}
+
+func (s *localCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.cache.Get(key), nil
+}
+
+func (s *localCacheStore) Set(ctx context.Context, key string, value []byte) error {
+	s.cache.Set(key, value)
+	return nil
+}
+
+type storageCacheStore struct {
+	storage storage.Storage
+	prefix  string
+}
+
+// NewStorageCacheStore creates a new cache store which saves entries as files under `prefix` in the given storage.
+// Errors fetching entries, e.g. because they don't exist, are treated as misses by CachingRequestor.
+func NewStorageCacheStore(s storage.Storage, prefix string) CacheStore {
+	return &storageCacheStore{storage: s, prefix: prefix}
+}
+
+func (s *storageCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	_, data, err := s.storage.Get(ctx, s.path(key))
+	return data, err
+}
+
+func (s *storageCacheStore) Set(ctx context.Context, key string, value []byte) error {
+	_, err := s.storage.Put(ctx, s.path(key), "application/json", value)
+	return err
+}
+
+func (s *storageCacheStore) path(key string) string {
+	return path.Join(s.prefix, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
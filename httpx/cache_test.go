@@ -0,0 +1,199 @@
+package httpx_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/cache"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingRequestor(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	setNow := func(t time.Time) { dates.SetNowSource(dates.NewFixedNowSource(t)) }
+	setNow(time.Date(2024, 7, 10, 12, 0, 0, 0, time.UTC))
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://temba.io/maxage": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`v1`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`v2`)),
+		},
+		"https://temba.io/etag": {
+			httpx.NewMockResponse(200, map[string]string{"ETag": `"abc"`}, []byte(`tagged`)),
+			httpx.NewMockResponse(304, map[string]string{"ETag": `"abc"`, "X-Updated": "yes"}, nil),
+			httpx.NewMockResponse(200, map[string]string{"ETag": `"def"`}, []byte(`retagged`)),
+		},
+		"https://temba.io/nostore": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "no-store"}, []byte(`a`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "no-store"}, []byte(`b`)),
+		},
+		"https://temba.io/big": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`0123456789ABCDEF`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`0123456789ABCDEF`)),
+		},
+		"https://temba.io/spoofed": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "no-store", "X-From-Cache": "1"}, []byte(`live`)),
+		},
+		"https://temba.io/post": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`p1`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`p2`)),
+		},
+	})
+
+	local := cache.NewLocal[string, []byte](nil, time.Hour)
+	httpx.SetRequestor(httpx.NewCachingRequestor(mocks, httpx.NewLocalCacheStore(local), 10))
+
+	call := func(method, url string, headers map[string]string) *httpx.Trace {
+		request, err := httpx.NewRequest(method, url, nil, headers)
+		require.NoError(t, err)
+		trace, err := httpx.DoTrace(http.DefaultClient, request, nil, nil, -1)
+		require.NoError(t, err)
+		return trace
+	}
+
+	// first request is a miss, second is a hit
+	trace := call("GET", "https://temba.io/maxage", nil)
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "v1", string(trace.ResponseBody))
+
+	trace = call("GET", "https://temba.io/maxage", nil)
+	assert.True(t, trace.CacheHit)
+	assert.Equal(t, "v1", string(trace.ResponseBody))
+	assert.Len(t, mocks.Requests(), 1)
+
+	// request can ask to bypass the cache
+	trace = call("GET", "https://temba.io/maxage", map[string]string{"Cache-Control": "no-cache"})
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "v2", string(trace.ResponseBody))
+
+	// response with only a validator is cached but revalidated on every use
+	trace = call("GET", "https://temba.io/etag", nil)
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "tagged", string(trace.ResponseBody))
+
+	trace = call("GET", "https://temba.io/etag", nil)
+	assert.True(t, trace.CacheHit)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, "tagged", string(trace.ResponseBody))
+	assert.Equal(t, "yes", trace.Response.Header.Get("X-Updated"))
+	assert.Equal(t, `"abc"`, mocks.Requests()[3].Header.Get("If-None-Match"))
+
+	trace = call("GET", "https://temba.io/etag", nil)
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "retagged", string(trace.ResponseBody))
+	assert.Equal(t, `"abc"`, mocks.Requests()[4].Header.Get("If-None-Match"))
+
+	// responses which can't be stored or are too big aren't cached, but their bodies are still returned
+	assert.Equal(t, "a", string(call("GET", "https://temba.io/nostore", nil).ResponseBody))
+	assert.Equal(t, "b", string(call("GET", "https://temba.io/nostore", nil).ResponseBody))
+	assert.Equal(t, "0123456789ABCDEF", string(call("GET", "https://temba.io/big", nil).ResponseBody))
+	assert.Equal(t, "0123456789ABCDEF", string(call("GET", "https://temba.io/big", nil).ResponseBody))
+
+	// remote servers can't pretend their responses came from the cache
+	trace = call("GET", "https://temba.io/spoofed", nil)
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "", trace.Response.Header.Get("X-From-Cache"))
+
+	// only GET requests are cached
+	assert.Equal(t, "p1", string(call("POST", "https://temba.io/post", nil).ResponseBody))
+	assert.Equal(t, "p2", string(call("POST", "https://temba.io/post", nil).ResponseBody))
+
+	assert.False(t, mocks.HasUnused())
+
+	// once max-age has passed, response is stale and without validators must be refetched
+	mocks = httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://temba.io/maxage": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`v3`)),
+		},
+	})
+	httpx.SetRequestor(httpx.NewCachingRequestor(mocks, httpx.NewLocalCacheStore(local), 10))
+
+	assert.True(t, call("GET", "https://temba.io/maxage", nil).CacheHit)
+
+	setNow(time.Date(2024, 7, 10, 12, 1, 30, 0, time.UTC))
+
+	trace = call("GET", "https://temba.io/maxage", nil)
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "v3", string(trace.ResponseBody))
+	assert.False(t, mocks.HasUnused())
+}
+
+func TestCachingRequestorVary(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://temba.io/": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"}, []byte(`hello`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"}, []byte(`hola`)),
+		},
+	})
+	httpx.SetRequestor(httpx.NewCachingRequestor(mocks, httpx.NewLocalCacheStore(cache.NewLocal[string, []byte](nil, time.Hour)), 0))
+
+	call := func(lang string) *httpx.Trace {
+		request, _ := httpx.NewRequest("GET", "https://temba.io/", nil, map[string]string{"Accept-Language": lang})
+		trace, err := httpx.DoTrace(http.DefaultClient, request, nil, nil, -1)
+		require.NoError(t, err)
+		return trace
+	}
+
+	assert.Equal(t, "hello", string(call("en").ResponseBody))
+	assert.True(t, call("en").CacheHit)
+	assert.Equal(t, "hola", string(call("es").ResponseBody))
+	assert.False(t, mocks.HasUnused())
+}
+
+func TestCachingRequestorCredentials(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://temba.io/": {
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`bob's`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`ann's`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`cookie`)),
+			httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte(`public`)),
+		},
+	})
+	httpx.SetRequestor(httpx.NewCachingRequestor(mocks, httpx.NewLocalCacheStore(cache.NewLocal[string, []byte](nil, time.Hour)), 0))
+
+	call := func(headers map[string]string) *httpx.Trace {
+		request, _ := httpx.NewRequest("GET", "https://temba.io/", nil, headers)
+		trace, err := httpx.DoTrace(http.DefaultClient, request, nil, nil, -1)
+		require.NoError(t, err)
+		return trace
+	}
+
+	// requests with credentials are neither served from nor saved to the cache
+	assert.Equal(t, "bob's", string(call(map[string]string{"Authorization": "Token bob"}).ResponseBody))
+	trace := call(map[string]string{"Authorization": "Token ann"})
+	assert.Equal(t, "ann's", string(trace.ResponseBody))
+	assert.False(t, trace.CacheHit)
+	assert.Equal(t, "cookie", string(call(map[string]string{"Cookie": "session=123"}).ResponseBody))
+
+	trace = call(nil)
+	assert.Equal(t, "public", string(trace.ResponseBody))
+	assert.False(t, trace.CacheHit)
+	assert.False(t, mocks.HasUnused())
+}
+
+func TestStorageCacheStore(t *testing.T) {
+	ctx := context.Background()
+	store := httpx.NewStorageCacheStore(storage.NewFS(t.TempDir(), 0766), "httpcache")
+
+	_, err := store.Get(ctx, "GET https://temba.io")
+	assert.Error(t, err)
+
+	err = store.Set(ctx, "GET https://temba.io", []byte(`{}`))
+	assert.NoError(t, err)
+
+	data, err := store.Get(ctx, "GET https://temba.io")
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
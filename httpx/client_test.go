@@ -0,0 +1,146 @@
+package httpx_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s certs=%d", r.Proto, len(r.TLS.PeerCertificates))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	call := func(client *http.Client) string {
+		req, err := httpx.NewRequest("GET", server.URL, nil, nil)
+		require.NoError(t, err)
+		trace, err := httpx.DoTrace(client, req, nil, nil, -1)
+		if err != nil {
+			return err.Error()
+		}
+		return string(trace.ResponseBody)
+	}
+
+	// server certificate isn't trusted by the system roots
+	assert.Contains(t, call(httpx.NewClient(&httpx.ClientOptions{})), "certificate signed by unknown authority")
+
+	options := httpx.NewClientOptions()
+	options.RootCAs = roots
+	assert.Equal(t, "HTTP/2.0 certs=0", call(httpx.NewClient(options)))
+
+	options.HTTP2 = false
+	assert.Equal(t, "HTTP/1.1 certs=0", call(httpx.NewClient(options)))
+}
+
+func TestNewClientWithClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "certs=%d", len(r.TLS.PeerCertificates))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	options := httpx.NewClientOptions()
+	options.RootCAs = roots
+
+	// server requires a client certificate
+	_, err := httpx.Do(httpx.NewClient(options), mustRequest(t, server.URL), nil, nil)
+	assert.Error(t, err)
+
+	// which can be anything, so use the server's own
+	options.Certificates = server.TLS.Certificates
+
+	trace, err := httpx.DoTrace(httpx.NewClient(options), mustRequest(t, server.URL), nil, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "certs=1", string(trace.ResponseBody))
+}
+
+func TestNewClientWithProxy(t *testing.T) {
+	var proxied []string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, fmt.Sprintf("%s %s auth=%s", r.Method, r.URL, r.Header.Get("Proxy-Authorization")))
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("bob", "sesame")
+
+	client := httpx.NewClient(httpx.NewClientOptions())
+
+	// request without a proxy goes direct (test server is localhost so environment proxy doesn't apply)
+	trace, err := httpx.DoTrace(client, mustRequest(t, server.URL+"/foo"), nil, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "direct", string(trace.ResponseBody))
+
+	// request with a proxy goes via the proxy with credentials
+	trace, err = httpx.DoTrace(client, httpx.WithProxy(mustRequest(t, "http://temba.io/foo"), proxyURL), nil, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "via proxy", string(trace.ResponseBody))
+	assert.Equal(t, []string{"GET http://temba.io/foo auth=Basic Ym9iOnNlc2FtZQ=="}, proxied)
+
+	// or a proxy can be set for all requests
+	options := httpx.NewClientOptions()
+	options.Proxy = proxyURL
+	trace, err = httpx.DoTrace(httpx.NewClient(options), mustRequest(t, "http://nyaruka.com/bar"), nil, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "via proxy", string(trace.ResponseBody))
+	assert.Len(t, proxied, 2)
+}
+
+func TestNewClientWithAccessConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	ips, nets, _ := httpx.ParseNetworks("127.0.0.1", "::1")
+
+	options := httpx.NewClientOptions()
+	options.Access = httpx.NewAccessConfig(time.Second, ips, nets)
+	options.DialTimeout = time.Second
+
+	// address is checked when connecting, without needing to resolve the host first
+	_, err := httpx.Do(httpx.NewClient(options), mustRequest(t, server.URL), nil, nil)
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	options.Access = httpx.NewAccessConfig(time.Second, []net.IP{net.ParseIP("10.1.1.1")}, nil)
+
+	resp, err := httpx.Do(httpx.NewClient(options), mustRequest(t, server.URL), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	req, err := httpx.NewRequest("GET", url, nil, nil)
+	require.NoError(t, err)
+	return req
+}
@@ -0,0 +1,54 @@
+package dbsink
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil"
+	"github.com/nyaruka/gocommon/httpx"
+)
+
+// db representation of a log
+type dbLog struct {
+	URL        string    `db:"url"`
+	StatusCode int       `db:"status_code"`
+	Request    string    `db:"request"`
+	Response   string    `db:"response"`
+	ElapsedMS  int       `db:"elapsed_ms"`
+	Retries    int       `db:"retries"`
+	CreatedOn  time.Time `db:"created_on"`
+}
+
+// LogWriter writes HTTP logs to a Postgres table with the columns url, status_code, request, response, elapsed_ms,
+// retries and created_on.
+type LogWriter struct {
+	db  dbutil.BulkQueryer
+	sql string
+}
+
+// NewLogWriter creates a new writer which inserts logs into the given table
+func NewLogWriter(db dbutil.BulkQueryer, table string) *LogWriter {
+	sql := fmt.Sprintf(`INSERT INTO %s(url, status_code, request, response, elapsed_ms, retries, created_on) VALUES(:url, :status_code, :request, :response, :elapsed_ms, :retries, :created_on)`, table)
+
+	return &LogWriter{db: db, sql: sql}
+}
+
+func (w *LogWriter) WriteLogs(ctx context.Context, logs []*httpx.Log) error {
+	rows := make([]*dbLog, len(logs))
+	for i, l := range logs {
+		rows[i] = &dbLog{
+			URL:        l.URL,
+			StatusCode: l.StatusCode,
+			Request:    l.Request,
+			Response:   l.Response,
+			ElapsedMS:  l.ElapsedMS,
+			Retries:    l.Retries,
+			CreatedOn:  l.CreatedOn,
+		}
+	}
+
+	return dbutil.BulkQuery(ctx, w.db, w.sql, rows)
+}
+
+var _ httpx.LogWriter = (*LogWriter)(nil)
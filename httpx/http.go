@@ -72,6 +72,7 @@ type Trace struct {
 	StartTime     time.Time
 	EndTime       time.Time
 	Retries       int
+	CacheHit      bool // whether response was served from a cache
 }
 
 func (t *Trace) String() string {
@@ -85,7 +86,8 @@ func (t *Trace) String() string {
 }
 
 // SanitizedRequest returns a valid UTF-8 string version of the request, substituting the body with a placeholder
-// if it isn't valid UTF-8. It also strips any NULL characters as not all external dependencies can handle those.
+// if it isn't valid UTF-8. If the body is multipart, only the content of file parts is substituted. It also strips any
+// NULL characters as not all external dependencies can handle those.
 func (t *Trace) SanitizedRequest(placeholder string) string {
 	// split request trace into headers and body
 	var headers, body []byte
@@ -98,6 +100,14 @@ func (t *Trace) SanitizedRequest(placeholder string) string {
 		body = nil
 	}
 
+	if t.Request != nil && len(body) > 0 {
+		if contentType := t.Request.Header.Get("Content-Type"); strings.HasPrefix(contentType, "multipart/") {
+			if stripped := stripMultipartFiles(contentType, body, placeholder); stripped != nil {
+				body = stripped
+			}
+		}
+	}
+
 	return santizedTrace(headers, body, placeholder)
 }
 
@@ -148,6 +158,7 @@ func DoTrace(client *http.Client, request *http.Request, retries *RetryConfig, a
 	response, retryCount, err := do(client, request, retries, access)
 	trace.Response = response
 	trace.Retries = retryCount
+	trace.CacheHit = isCacheHit(response)
 
 	if err != nil {
 		return trace, err
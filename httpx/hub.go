@@ -0,0 +1,324 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSocketExists is returned when adding a socket to a hub with an ID that is already in use
+var ErrSocketExists = errors.New("socket with that ID already exists")
+
+// ErrSocketNotFound is returned when referencing a socket that isn't in a hub
+var ErrSocketNotFound = errors.New("no socket with that ID")
+
+// ErrSocketStarted is returned when adding a socket to a hub which has already been started or closed
+var ErrSocketStarted = errors.New("socket has already been started")
+
+// WebSocketHub tracks web sockets by ID, groups them into rooms and broadcasts messages to them. Each socket has its
+// own bounded queue of outgoing messages so that a slow socket can't block sending to other sockets - if a socket's
+// queue is full, messages to it are dropped.
+type WebSocketHub struct {
+	queueSize int
+
+	mutex   sync.RWMutex
+	sockets map[string]*hubSocket
+	rooms   map[string]map[string]bool
+
+	onConnect    func(string)
+	onDisconnect func(string, int)
+	onJoin       func(string, string)
+	onLeave      func(string, string)
+	onDrop       func(string, []byte)
+}
+
+type hubSocket struct {
+	socket  WebSocket
+	queue   chan []byte
+	rooms   map[string]bool
+	dropped atomic.Int64
+}
+
+// NewWebSocketHub creates a new hub where each socket can have up to `queueSize` queued outgoing messages
+func NewWebSocketHub(queueSize int) *WebSocketHub {
+	return &WebSocketHub{
+		queueSize: queueSize,
+		sockets:   make(map[string]*hubSocket),
+		rooms:     make(map[string]map[string]bool),
+
+		onConnect:    func(string) {},
+		onDisconnect: func(string, int) {},
+		onJoin:       func(string, string) {},
+		onLeave:      func(string, string) {},
+		onDrop:       func(string, []byte) {},
+	}
+}
+
+// OnConnect is called when a socket is added to the hub
+func (h *WebSocketHub) OnConnect(fn func(id string)) { h.onConnect = fn }
+
+// OnDisconnect is called when a socket in the hub is closed, after it has left all its rooms
+func (h *WebSocketHub) OnDisconnect(fn func(id string, code int)) { h.onDisconnect = fn }
+
+// OnJoin is called when a socket joins a room
+func (h *WebSocketHub) OnJoin(fn func(id, room string)) { h.onJoin = fn }
+
+// OnLeave is called when a socket leaves a room, including when it's closed
+func (h *WebSocketHub) OnLeave(fn func(id, room string)) { h.onLeave = fn }
+
+// OnDrop is called when a message to a socket is dropped because its queue is full
+func (h *WebSocketHub) OnDrop(fn func(id string, msg []byte)) { h.onDrop = fn }
+
+// Add adds the given socket to this hub. It must be called before the socket is started, as the hub takes over the
+// socket's OnClose callback, so callers should use OnDisconnect instead.
+func (h *WebSocketHub) Add(id string, sock WebSocket) error {
+	if s, ok := sock.(interface{ hasStarted() bool }); ok && s.hasStarted() {
+		return ErrSocketStarted
+	}
+
+	h.mutex.Lock()
+
+	if _, exists := h.sockets[id]; exists {
+		h.mutex.Unlock()
+		return ErrSocketExists
+	}
+
+	hs := &hubSocket{socket: sock, queue: make(chan []byte, h.queueSize), rooms: make(map[string]bool)}
+	h.sockets[id] = hs
+
+	sock.OnClose(func(code int) { h.remove(id, hs, code) })
+
+	h.mutex.Unlock()
+
+	go hs.pump()
+
+	h.onConnect(id)
+	return nil
+}
+
+// Join adds the socket with the given ID to the given room
+func (h *WebSocketHub) Join(id, room string) error {
+	h.mutex.Lock()
+
+	hs := h.sockets[id]
+	if hs == nil {
+		h.mutex.Unlock()
+		return ErrSocketNotFound
+	}
+
+	if hs.rooms[room] {
+		h.mutex.Unlock()
+		return nil
+	}
+
+	hs.rooms[room] = true
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[string]bool)
+	}
+	h.rooms[room][id] = true
+
+	h.mutex.Unlock()
+
+	h.onJoin(id, room)
+	return nil
+}
+
+// Leave removes the socket with the given ID from the given room
+func (h *WebSocketHub) Leave(id, room string) error {
+	h.mutex.Lock()
+
+	hs := h.sockets[id]
+	if hs == nil {
+		h.mutex.Unlock()
+		return ErrSocketNotFound
+	}
+
+	if !hs.rooms[room] {
+		h.mutex.Unlock()
+		return nil
+	}
+
+	h.leave(id, hs, room)
+
+	h.mutex.Unlock()
+
+	h.onLeave(id, room)
+	return nil
+}
+
+// Send queues the given message to the socket with the given ID
+func (h *WebSocketHub) Send(id string, msg []byte) error {
+	h.mutex.RLock()
+	hs := h.sockets[id]
+	if hs == nil {
+		h.mutex.RUnlock()
+		return ErrSocketNotFound
+	}
+
+	queued := hs.enqueue(msg)
+	h.mutex.RUnlock()
+
+	if !queued {
+		h.onDrop(id, msg)
+	}
+	return nil
+}
+
+// Broadcast queues the given message to all sockets in the given room, returning the number of sockets it was queued for
+func (h *WebSocketHub) Broadcast(room string, msg []byte) int {
+	h.mutex.RLock()
+	ids := make([]string, 0, len(h.rooms[room]))
+	for id := range h.rooms[room] {
+		ids = append(ids, id)
+	}
+	h.mutex.RUnlock()
+
+	return h.sendAll(ids, msg)
+}
+
+// BroadcastAll queues the given message to all sockets in the hub, returning the number of sockets it was queued for
+func (h *WebSocketHub) BroadcastAll(msg []byte) int {
+	h.mutex.RLock()
+	ids := make([]string, 0, len(h.sockets))
+	for id := range h.sockets {
+		ids = append(ids, id)
+	}
+	h.mutex.RUnlock()
+
+	return h.sendAll(ids, msg)
+}
+
+// Members returns the sorted IDs of the sockets in the given room
+func (h *WebSocketHub) Members(room string) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return sortedKeys(h.rooms[room])
+}
+
+// Rooms returns the sorted names of the rooms that the socket with the given ID is in
+func (h *WebSocketHub) Rooms(id string) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if hs := h.sockets[id]; hs != nil {
+		return sortedKeys(hs.rooms)
+	}
+	return []string{}
+}
+
+// Stats returns the traffic stats of each socket in this hub by ID, where queue depths and dropped counts include
+// messages queued or dropped by the hub
+func (h *WebSocketHub) Stats() map[string]WebSocketStats {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	stats := make(map[string]WebSocketStats, len(h.sockets))
+	for id, hs := range h.sockets {
+		s := hs.socket.Stats()
+		s.QueueDepth += len(hs.queue)
+		s.MessagesDropped += hs.dropped.Load()
+		stats[id] = s
+	}
+	return stats
+}
+
+// TotalStats returns the combined traffic stats of all sockets in this hub
+func (h *WebSocketHub) TotalStats() WebSocketStats {
+	var total WebSocketStats
+	for _, s := range h.Stats() {
+		total = total.Add(s)
+	}
+	return total
+}
+
+// Len returns the number of sockets in this hub
+func (h *WebSocketHub) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.sockets)
+}
+
+func (h *WebSocketHub) sendAll(ids []string, msg []byte) int {
+	sent := 0
+	for _, id := range ids {
+		h.mutex.RLock()
+		hs := h.sockets[id]
+		queued := hs != nil && hs.enqueue(msg)
+		h.mutex.RUnlock()
+
+		if queued {
+			sent++
+		} else if hs != nil {
+			h.onDrop(id, msg)
+		}
+	}
+	return sent
+}
+
+// removes a socket which has closed
+func (h *WebSocketHub) remove(id string, hs *hubSocket, code int) {
+	h.mutex.Lock()
+
+	// check this is still the socket we added with this ID
+	if h.sockets[id] != hs {
+		h.mutex.Unlock()
+		return
+	}
+
+	rooms := sortedKeys(hs.rooms)
+	for _, room := range rooms {
+		h.leave(id, hs, room)
+	}
+
+	delete(h.sockets, id)
+	close(hs.queue)
+
+	h.mutex.Unlock()
+
+	for _, room := range rooms {
+		h.onLeave(id, room)
+	}
+	h.onDisconnect(id, code)
+}
+
+// removes a socket from a room, must be called with the hub locked
+func (h *WebSocketHub) leave(id string, hs *hubSocket, room string) {
+	delete(hs.rooms, room)
+	delete(h.rooms[room], id)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// tries to queue the given message without blocking, must be called with the hub read locked so that the queue can't
+// be closed
+func (s *hubSocket) enqueue(msg []byte) bool {
+	select {
+	case s.queue <- msg:
+		return true
+	default:
+		s.dropped.Add(1)
+		return false
+	}
+}
+
+// sends queued messages to the socket until the queue is closed
+func (s *hubSocket) pump() {
+	for msg := range s.queue {
+		// socket may have started closing since the message was queued, but that's fine
+		s.socket.SendContext(context.Background(), msg)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,153 @@
+package httpx_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketHub(t *testing.T) {
+	hub := httpx.NewWebSocketHub(10)
+
+	var events []string
+	var eventsMutex sync.Mutex
+	addEvent := func(e string) {
+		eventsMutex.Lock()
+		events = append(events, e)
+		eventsMutex.Unlock()
+	}
+
+	hub.OnConnect(func(id string) { addEvent("connect:" + id) })
+	hub.OnDisconnect(func(id string, code int) { addEvent(fmt.Sprintf("disconnect:%s:%d", id, code)) })
+	hub.OnJoin(func(id, room string) { addEvent("join:" + id + ":" + room) })
+	hub.OnLeave(func(id, room string) { addEvent("leave:" + id + ":" + room) })
+
+	nextID := 0
+	serverURL := newSocketServer(t, func(ws httpx.WebSocket) {
+		nextID++
+		assert.NoError(t, hub.Add(fmt.Sprintf("s%d", nextID), ws))
+		ws.Start()
+
+		// sockets can't be added once started
+		assert.Equal(t, httpx.ErrSocketStarted, hub.Add("late", ws))
+	})
+
+	conn1 := newSocketConnection(t, serverURL)
+	conn2 := newSocketConnection(t, serverURL)
+	conn3 := newSocketConnection(t, serverURL)
+
+	assert.Equal(t, 3, hub.Len())
+
+	assert.NoError(t, hub.Join("s1", "support"))
+	assert.NoError(t, hub.Join("s2", "support"))
+	assert.NoError(t, hub.Join("s2", "sales"))
+	assert.NoError(t, hub.Join("s2", "sales")) // noop
+	assert.Equal(t, httpx.ErrSocketNotFound, hub.Join("s9", "sales"))
+
+	assert.Equal(t, []string{"s1", "s2"}, hub.Members("support"))
+	assert.Equal(t, []string{"s2"}, hub.Members("sales"))
+	assert.Equal(t, []string{}, hub.Members("marketing"))
+	assert.Equal(t, []string{"sales", "support"}, hub.Rooms("s2"))
+	assert.Equal(t, []string{}, hub.Rooms("s3"))
+
+	readMessage := func(c *websocket.Conn) string {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			return ""
+		}
+		return string(msg)
+	}
+
+	assert.Equal(t, 2, hub.Broadcast("support", []byte("to support")))
+	assert.Equal(t, "to support", readMessage(conn1))
+	assert.Equal(t, "to support", readMessage(conn2))
+
+	assert.NoError(t, hub.Send("s3", []byte("to s3")))
+	assert.Equal(t, "to s3", readMessage(conn3))
+	assert.Equal(t, httpx.ErrSocketNotFound, hub.Send("s9", []byte("to s9")))
+
+	assert.Equal(t, 3, hub.BroadcastAll([]byte("to all")))
+	assert.Equal(t, "to all", readMessage(conn1))
+	assert.Equal(t, "to all", readMessage(conn2))
+	assert.Equal(t, "to all", readMessage(conn3))
+
+	assert.NoError(t, hub.Leave("s1", "support"))
+	assert.Equal(t, []string{"s2"}, hub.Members("support"))
+
+	// closing a socket removes it from the hub and its rooms
+	conn2.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	conn2.Close()
+	time.Sleep(250 * time.Millisecond)
+
+	assert.Equal(t, 2, hub.Len())
+	assert.Equal(t, []string{}, hub.Members("support"))
+	assert.Equal(t, 0, hub.Broadcast("sales", []byte("to sales")))
+
+	conn1.Close()
+	conn3.Close()
+	time.Sleep(250 * time.Millisecond)
+
+	assert.Equal(t, 0, hub.Len())
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	// last two sockets can disconnect in any order
+	assert.Equal(t, []string{
+		"connect:s1", "connect:s2", "connect:s3",
+		"join:s1:support", "join:s2:support", "join:s2:sales",
+		"leave:s1:support",
+		"leave:s2:sales", "leave:s2:support", "disconnect:s2:1001",
+	}, events[:10])
+	assert.ElementsMatch(t, []string{"disconnect:s1:1006", "disconnect:s3:1006"}, events[10:])
+}
+
+func TestWebSocketHubBackpressure(t *testing.T) {
+	hub := httpx.NewWebSocketHub(1)
+
+	var dropped []string
+	var droppedMutex sync.Mutex
+	hub.OnDrop(func(id string, msg []byte) {
+		droppedMutex.Lock()
+		dropped = append(dropped, id+":"+string(msg))
+		droppedMutex.Unlock()
+	})
+
+	var sock httpx.WebSocket
+	serverURL := newSocketServer(t, func(ws httpx.WebSocket) {
+		sock = ws
+		assert.NoError(t, hub.Add("slow", ws))
+		assert.Equal(t, httpx.ErrSocketExists, hub.Add("slow", ws))
+
+		// socket is never started so nothing leaves its outbox
+	})
+
+	newSocketConnection(t, serverURL)
+
+	// socket outbox has capacity of 5, and hub queue 1, so eventually messages get dropped
+	sent := 0
+	for i := 0; i < 10; i++ {
+		sent += hub.BroadcastAll([]byte(fmt.Sprintf("m%d", i)))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 7, sent)
+
+	droppedMutex.Lock()
+	assert.Equal(t, []string{"slow:m7", "slow:m8", "slow:m9"}, dropped)
+	droppedMutex.Unlock()
+
+	// queue depth includes the socket's outbox and hub queue but not the message waiting to go into the outbox
+	stats := hub.Stats()
+	assert.Equal(t, 6, stats["slow"].QueueDepth)
+	assert.Equal(t, int64(3), stats["slow"].MessagesDropped)
+	assert.Equal(t, stats["slow"], hub.TotalStats())
+
+	assert.NotNil(t, sock)
+}
@@ -0,0 +1,297 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/nyaruka/gocommon/storage"
+)
+
+// MultipartBuilder builds multipart/form-data request bodies from fields and files. File content isn't read until the
+// body is written, so files from storage are fetched one at a time as the request is sent.
+type MultipartBuilder struct {
+	boundary string
+	parts    []*multipartSource
+}
+
+type multipartSource struct {
+	name        string
+	filename    string
+	contentType string
+	content     func(context.Context) (string, io.Reader, error)
+	replayable  bool
+}
+
+// readers whose content can be read again from the start, e.g. bytes.Reader and strings.Reader
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// NewMultipartBuilder creates a new empty multipart builder
+func NewMultipartBuilder() *MultipartBuilder {
+	return &MultipartBuilder{boundary: multipart.NewWriter(nil).Boundary()}
+}
+
+// AddField adds a regular form field
+func (b *MultipartBuilder) AddField(name, value string) *MultipartBuilder {
+	b.parts = append(b.parts, &multipartSource{
+		name:       name,
+		content:    func(context.Context) (string, io.Reader, error) { return "", strings.NewReader(value), nil },
+		replayable: true,
+	})
+	return b
+}
+
+// AddFile adds a file with the given content. If content type is empty, application/octet-stream is used. Note that
+// unless the content is a reader like bytes.Reader which can be read from the start again, it can only be read once,
+// so requests with it can't be replayed.
+func (b *MultipartBuilder) AddFile(name, filename, contentType string, content io.Reader) *MultipartBuilder {
+	source := &multipartSource{
+		name:        name,
+		filename:    filename,
+		contentType: contentType,
+		content:     func(context.Context) (string, io.Reader, error) { return "", content, nil },
+	}
+
+	if ra, ok := content.(sizedReaderAt); ok {
+		source.content = func(context.Context) (string, io.Reader, error) {
+			return "", io.NewSectionReader(ra, 0, ra.Size()), nil
+		}
+		source.replayable = true
+	}
+
+	b.parts = append(b.parts, source)
+	return b
+}
+
+// AddFileBytes adds a file with the given content. If content type is empty, application/octet-stream is used.
+func (b *MultipartBuilder) AddFileBytes(name, filename, contentType string, content []byte) *MultipartBuilder {
+	return b.AddFile(name, filename, contentType, bytes.NewReader(content))
+}
+
+// AddStorageFile adds a file whose content is fetched from the given storage when the body is written. If content type
+// is empty, it's detected from the content.
+func (b *MultipartBuilder) AddStorageFile(name, filename, contentType string, s storage.Storage, path string) *MultipartBuilder {
+	b.parts = append(b.parts, &multipartSource{
+		name:        name,
+		filename:    filename,
+		contentType: contentType,
+		content: func(ctx context.Context) (string, io.Reader, error) {
+			_, body, err := s.Get(ctx, path)
+			if err != nil {
+				return "", nil, fmt.Errorf("error fetching %s from %s: %w", path, s.Name(), err)
+			}
+
+			detected, _ := DetectContentType(body)
+			return detected, bytes.NewReader(body), nil
+		},
+		replayable: true,
+	})
+	return b
+}
+
+// ContentType returns the content type header value for bodies from this builder
+func (b *MultipartBuilder) ContentType() string {
+	return "multipart/form-data; boundary=" + b.boundary
+}
+
+// Replayable returns whether bodies from this builder can be written more than once, i.e. it has no files with content
+// which can only be read once
+func (b *MultipartBuilder) Replayable() bool {
+	for _, p := range b.parts {
+		if !p.replayable {
+			return false
+		}
+	}
+	return true
+}
+
+// Body returns a reader which streams the body. Any error getting file content is returned from the reader. Writing
+// starts on the first read, and closing the reader stops it.
+func (b *MultipartBuilder) Body(ctx context.Context) io.ReadCloser {
+	return &multipartBody{write: func(w io.Writer) error { return b.write(ctx, w) }}
+}
+
+// NewRequest creates a new request with a streamed multipart body. If the builder is replayable, the request can be
+// replayed, e.g. to follow a redirect.
+func (b *MultipartBuilder) NewRequest(ctx context.Context, method, url string, headers map[string]string) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, url, b.Body(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Replayable() {
+		r.GetBody = func() (io.ReadCloser, error) { return b.Body(ctx), nil }
+	}
+	r.Header.Set("Content-Type", b.ContentType())
+
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+
+	return r, nil
+}
+
+func (b *MultipartBuilder) write(ctx context.Context, w io.Writer) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(b.boundary)
+
+	for _, p := range b.parts {
+		detectedType, content, err := p.content(ctx)
+		if err != nil {
+			return err
+		}
+
+		header := textproto.MIMEHeader{}
+
+		if p.filename != "" {
+			contentType := p.contentType
+			if contentType == "" {
+				contentType = detectedType
+			}
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(p.name), escapeQuotes(p.filename)))
+			header.Set("Content-Type", contentType)
+		} else {
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(p.name)))
+		}
+
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(pw, content); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// body which is written through a pipe by a goroutine started on the first read, so that a body which is never read
+// doesn't leave a goroutine blocked on the pipe
+type multipartBody struct {
+	write func(io.Writer) error
+
+	mutex  sync.Mutex
+	pr     *io.PipeReader
+	closed bool
+}
+
+func (m *multipartBody) Read(p []byte) (int, error) {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if m.pr == nil {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(m.write(pw)) }()
+		m.pr = pr
+	}
+	pr := m.pr
+	m.mutex.Unlock()
+
+	return pr.Read(p)
+}
+
+func (m *multipartBody) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	if m.pr != nil {
+		return m.pr.Close()
+	}
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// MultipartPart is a part of a parsed multipart body
+type MultipartPart struct {
+	Header   textproto.MIMEHeader
+	Name     string
+	Filename string
+	Body     []byte
+}
+
+// IsFile returns whether this part is a file rather than a regular form field
+func (p *MultipartPart) IsFile() bool {
+	return p.Filename != ""
+}
+
+// ParseMultipart parses a multipart body with the given content type header value
+func ParseMultipart(contentType string, body []byte) ([]*MultipartPart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing content type: %w", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("content type %s is not multipart", mediaType)
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	parts := make([]*MultipartPart, 0, 2)
+
+	for {
+		p, err := reader.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading multipart body: %w", err)
+		}
+
+		partBody, err := io.ReadAll(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading multipart body: %w", err)
+		}
+
+		parts = append(parts, &MultipartPart{Header: p.Header, Name: p.FormName(), Filename: p.FileName(), Body: partBody})
+	}
+}
+
+// replaces the content of file parts in a multipart body with the given placeholder, returning nil if the body can't
+// be parsed, e.g. it's been truncated
+func stripMultipartFiles(contentType string, body []byte, placeholder string) []byte {
+	parts, err := ParseMultipart(contentType, body)
+	if err != nil || len(parts) == 0 {
+		return nil
+	}
+
+	_, params, _ := mime.ParseMediaType(contentType)
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	mw.SetBoundary(params["boundary"])
+
+	for _, p := range parts {
+		pw, _ := mw.CreatePart(p.Header)
+
+		if p.IsFile() {
+			pw.Write([]byte(placeholder))
+		} else {
+			pw.Write(p.Body)
+		}
+	}
+
+	mw.Close()
+
+	return b.Bytes()
+}
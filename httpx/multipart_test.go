@@ -0,0 +1,156 @@
+package httpx_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartBuilder(t *testing.T) {
+	ctx := context.Background()
+	png := []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A, 0x00, 0xFF}
+
+	store := storage.NewFS(t.TempDir(), 0766)
+	_, err := store.Put(ctx, "media/photo.png", "image/png", png)
+	require.NoError(t, err)
+
+	var received map[string]string
+	var receivedTrace string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder, err := httpx.NewRecorder(r, w, true)
+		require.NoError(t, err)
+
+		require.NoError(t, r.ParseMultipartForm(1024))
+
+		received = map[string]string{"text": r.FormValue("text"), "quote": r.FormValue(`"q"`)}
+		for _, name := range []string{"doc", "photo"} {
+			f, h, err := r.FormFile(name)
+			require.NoError(t, err)
+			content, _ := io.ReadAll(f)
+			received[name] = fmt.Sprintf("%s|%s|%d", h.Filename, h.Header.Get("Content-Type"), len(content))
+		}
+
+		recorder.ResponseWriter.WriteHeader(http.StatusOK)
+		recorder.ResponseWriter.Write([]byte(`{"status": "ok"}`))
+
+		require.NoError(t, recorder.End())
+		receivedTrace = recorder.Trace.SanitizedRequest("<file>")
+	}))
+	defer server.Close()
+
+	builder := httpx.NewMultipartBuilder().
+		AddField("text", "Hello world").
+		AddField(`"q"`, "quoted").
+		AddFile("doc", "doc.txt", "text/plain", strings.NewReader("some text")).
+		AddStorageFile("photo", "photo.png", "", store, "media/photo.png")
+
+	assert.True(t, strings.HasPrefix(builder.ContentType(), "multipart/form-data; boundary="))
+	boundary := strings.TrimPrefix(builder.ContentType(), "multipart/form-data; boundary=")
+
+	req, err := builder.NewRequest(ctx, "POST", server.URL+"/upload", map[string]string{"X-Foo": "bar"})
+	require.NoError(t, err)
+	assert.Equal(t, builder.ContentType(), req.Header.Get("Content-Type"))
+	assert.Equal(t, "bar", req.Header.Get("X-Foo"))
+
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+
+	assert.Equal(t, map[string]string{
+		"text":  "Hello world",
+		"quote": "quoted",
+		"doc":   "doc.txt|text/plain|9",
+		"photo": "photo.png|image/png|10",
+	}, received)
+
+	expectedBody := "--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"text\"\r\n\r\nHello world\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"\\\"q\\\"\"\r\n\r\nquoted\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"doc\"; filename=\"doc.txt\"\r\nContent-Type: text/plain\r\n\r\n<file>\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"photo.png\"\r\nContent-Type: image/png\r\n\r\n<file>\r\n" +
+		"--" + boundary + "--\r\n"
+
+	// file parts are stripped from sanitized client and server traces
+	assert.True(t, strings.HasSuffix(trace.SanitizedRequest("<file>"), "\r\n\r\n"+expectedBody))
+	assert.True(t, strings.HasSuffix(receivedTrace, "\r\n\r\n"+expectedBody))
+
+	// requests with fields, storage files and re-readable files can be replayed
+	assert.True(t, builder.Replayable())
+	require.NotNil(t, req.GetBody)
+	body, err := req.GetBody()
+	require.NoError(t, err)
+	content, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "some text")
+	assert.Contains(t, string(content), string(png))
+
+	bytesReq, err := httpx.NewMultipartBuilder().AddFileBytes("doc", "doc.txt", "", []byte("some bytes")).NewRequest(ctx, "POST", server.URL, nil)
+	require.NoError(t, err)
+	require.NotNil(t, bytesReq.GetBody)
+	for i := 0; i < 2; i++ {
+		body, err = bytesReq.GetBody()
+		require.NoError(t, err)
+		content, _ = io.ReadAll(body)
+		assert.Contains(t, string(content), "some bytes")
+	}
+
+	// but requests with files from one-shot readers can't be
+	oneShot := httpx.NewMultipartBuilder().AddField("text", "Hello").AddFile("doc", "doc.txt", "", io.MultiReader(strings.NewReader("some text")))
+	assert.False(t, oneShot.Replayable())
+	oneShotReq, err := oneShot.NewRequest(ctx, "POST", server.URL, nil)
+	require.NoError(t, err)
+	assert.Nil(t, oneShotReq.GetBody)
+
+	// bodies don't start writing until read, and can be closed without being read
+	unread := oneShot.Body(ctx)
+	assert.NoError(t, unread.Close())
+	_, err = unread.Read(make([]byte, 10))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	// error fetching a file from storage is returned when sending the request
+	req, err = httpx.NewMultipartBuilder().AddStorageFile("photo", "photo.png", "", store, "media/missing.png").NewRequest(ctx, "POST", server.URL, nil)
+	require.NoError(t, err)
+	_, err = httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	assert.ErrorContains(t, err, "error fetching media/missing.png from file system")
+}
+
+func TestParseMultipart(t *testing.T) {
+	body := "--XYZ\r\nContent-Disposition: form-data; name=\"text\"\r\n\r\nHello\r\n" +
+		"--XYZ\r\nContent-Disposition: form-data; name=\"doc\"; filename=\"doc.txt\"\r\nContent-Type: text/plain\r\n\r\nfile content\r\n" +
+		"--XYZ--\r\n"
+
+	parts, err := httpx.ParseMultipart("multipart/form-data; boundary=XYZ", []byte(body))
+	assert.NoError(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "text", parts[0].Name)
+	assert.Equal(t, "", parts[0].Filename)
+	assert.False(t, parts[0].IsFile())
+	assert.Equal(t, "Hello", string(parts[0].Body))
+	assert.Equal(t, "doc", parts[1].Name)
+	assert.Equal(t, "doc.txt", parts[1].Filename)
+	assert.True(t, parts[1].IsFile())
+	assert.Equal(t, "text/plain", parts[1].Header.Get("Content-Type"))
+	assert.Equal(t, "file content", string(parts[1].Body))
+
+	_, err = httpx.ParseMultipart("text/plain", []byte(body))
+	assert.EqualError(t, err, "content type text/plain is not multipart")
+
+	_, err = httpx.ParseMultipart("multipart/form-data; boundary=XYZ", []byte(body[:len(body)-20]))
+	assert.EqualError(t, err, "error reading multipart body: unexpected EOF")
+
+	_, err = httpx.ParseMultipart("", []byte(body))
+	assert.EqualError(t, err, "error parsing content type: mime: no media type")
+}
@@ -0,0 +1,229 @@
+package httpx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/stringsx"
+)
+
+// how long before actual expiry that we consider a token expired
+const oauthExpiryDelta = 10 * time.Second
+
+// max size of a token endpoint response
+const maxTokenResponseBytes = 64 * 1024
+
+// how many previously obtained tokens we remember for redaction
+const maxRedactedTokens = 10
+
+// OAuthToken is an access token obtained from an OAuth2 token endpoint
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresIn    int       `json:"expires_in,omitempty"`
+	Expiry       time.Time `json:"-"`
+}
+
+// Valid returns whether this token has an access token and hasn't expired
+func (t *OAuthToken) Valid() bool {
+	return t != nil && t.AccessToken != "" && (t.Expiry.IsZero() || dates.Now().Add(oauthExpiryDelta).Before(t.Expiry))
+}
+
+// authorization returns the value for Authorization headers
+func (t *OAuthToken) authorization() string {
+	tokenType := t.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + t.AccessToken
+}
+
+// OAuthConfig configures how an OAuthRequestor obtains tokens
+type OAuthConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// if set, tokens are obtained with the refresh_token grant rather than the client_credentials grant
+	RefreshToken string
+}
+
+// OAuthRequestor is a requestor which authorizes requests with OAuth2 bearer tokens, obtaining them via the client
+// credentials or refresh token grants, caching them until they expire, and refreshing them if a request is rejected
+// with a 401. Tokens are set on copies of requests so they never appear in request traces.
+type OAuthRequestor struct {
+	next   Requestor
+	config *OAuthConfig
+
+	mutex        sync.Mutex
+	token        *OAuthToken
+	refreshToken string
+	secrets      []string
+}
+
+// NewOAuthRequestor creates a new OAuth requestor which makes actual requests, including token requests, with `next`
+func NewOAuthRequestor(next Requestor, config *OAuthConfig) *OAuthRequestor {
+	return &OAuthRequestor{next: next, config: config, refreshToken: config.RefreshToken}
+}
+
+// Do makes the given request with an access token, refreshing the token once if it's rejected
+func (r *OAuthRequestor) Do(client *http.Client, request *http.Request) (*http.Response, error) {
+	token, err := r.Token(client)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := r.next.Do(client, authorize(request, token))
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	// can't retry a request whose body can't be re-read
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return response, nil
+	}
+
+	token, err = r.refresh(client, token)
+	if err != nil {
+		return response, nil
+	}
+
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		if retry.Body, err = request.GetBody(); err != nil {
+			return response, nil
+		}
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	return r.next.Do(client, authorize(retry, token))
+}
+
+// Token returns the current token, fetching a new one if we don't have a valid one
+func (r *OAuthRequestor) Token(client *http.Client) (*OAuthToken, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.token.Valid() {
+		return r.token, nil
+	}
+
+	return r.fetchToken(client)
+}
+
+// Redactor returns a redactor which masks the client secret and any tokens obtained by this requestor, for use when
+// creating logs from traces.
+func (r *OAuthRequestor) Redactor(mask string) stringsx.Redactor {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	values := make([]string, 0, len(r.secrets)+2)
+	for _, v := range append([]string{r.config.ClientSecret, r.config.RefreshToken}, r.secrets...) {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return stringsx.NewRedactor(mask, values...)
+}
+
+// fetches a new token unless the given stale token has already been replaced by another request
+func (r *OAuthRequestor) refresh(client *http.Client, stale *OAuthToken) (*OAuthToken, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.token != stale && r.token.Valid() {
+		return r.token, nil
+	}
+
+	return r.fetchToken(client)
+}
+
+func (r *OAuthRequestor) fetchToken(client *http.Client) (*OAuthToken, error) {
+	form := url.Values{}
+	if r.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", r.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(r.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(r.config.Scopes, " "))
+	}
+
+	request, err := NewRequest(http.MethodPost, r.config.TokenURL, strings.NewReader(form.Encode()), map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded",
+		"Accept":        "application/json",
+		"Authorization": "Basic " + BasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := r.next.Do(client, request)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting OAuth token: %w", err)
+	}
+
+	body, err := readBody(response, maxTokenResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OAuth token response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		jsonx.Unmarshal(body, &e)
+		if e.Error != "" {
+			return nil, fmt.Errorf("error requesting OAuth token: %s", e.Error)
+		}
+		return nil, fmt.Errorf("error requesting OAuth token: received status %d", response.StatusCode)
+	}
+
+	token := &OAuthToken{}
+	if err := jsonx.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("error unmarshalling OAuth token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("error requesting OAuth token: response has no access token")
+	}
+	if token.ExpiresIn > 0 {
+		token.Expiry = dates.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	// servers may rotate refresh tokens
+	if token.RefreshToken != "" {
+		r.refreshToken = token.RefreshToken
+		r.secrets = append(r.secrets, token.RefreshToken)
+	}
+
+	r.secrets = append(r.secrets, token.AccessToken)
+	if len(r.secrets) > maxRedactedTokens {
+		r.secrets = r.secrets[len(r.secrets)-maxRedactedTokens:]
+	}
+
+	r.token = token
+	return token, nil
+}
+
+var _ Requestor = (*OAuthRequestor)(nil)
+
+// returns a copy of the given request with the given token
+func authorize(request *http.Request, token *OAuthToken) *http.Request {
+	authed := request.Clone(request.Context())
+	authed.Header.Set("Authorization", token.authorization())
+	return authed
+}
@@ -0,0 +1,128 @@
+package httpx_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthRequestor(t *testing.T) {
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2024, 7, 10, 12, 0, 0, 0, time.UTC)))
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://auth.temba.io/token": {
+			httpx.NewMockResponse(200, nil, []byte(`{"access_token": "tok1", "token_type": "bearer", "expires_in": 3600}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{"access_token": "tok2", "token_type": "bearer", "expires_in": 3600}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{"access_token": "tok3", "token_type": "bearer", "expires_in": 3600}`)),
+			httpx.NewMockResponse(400, nil, []byte(`{"error": "invalid_client"}`)),
+		},
+		"https://api.temba.io/send": {
+			httpx.NewMockResponse(200, nil, []byte(`sent1`)),
+			httpx.NewMockResponse(401, nil, []byte(`expired`)),
+			httpx.NewMockResponse(200, nil, []byte(`sent2`)),
+			httpx.NewMockResponse(200, nil, []byte(`sent3`)),
+		},
+	})
+
+	requestor := httpx.NewOAuthRequestor(mocks, &httpx.OAuthConfig{
+		TokenURL:     "https://auth.temba.io/token",
+		ClientID:     "acme",
+		ClientSecret: "sesame",
+		Scopes:       []string{"send", "read"},
+	})
+
+	send := func(body string) (*http.Response, error) {
+		request, err := httpx.NewRequest("POST", "https://api.temba.io/send", strings.NewReader(body), nil)
+		require.NoError(t, err)
+		return requestor.Do(http.DefaultClient, request)
+	}
+
+	// first request fetches a token
+	response, err := send("msg1")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+
+	requests := mocks.Requests()
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "Basic YWNtZTpzZXNhbWU=", requests[0].Header.Get("Authorization"))
+	tokenBody, _ := io.ReadAll(requests[0].Body)
+	assert.Equal(t, "grant_type=client_credentials&scope=send+read", string(tokenBody))
+	assert.Equal(t, "Bearer tok1", requests[1].Header.Get("Authorization"))
+
+	// second request is rejected so token is refreshed and request retried once
+	response, err = send("msg2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	body, _ := io.ReadAll(response.Body)
+	assert.Equal(t, "sent2", string(body))
+
+	requests = mocks.Requests()
+	assert.Len(t, requests, 5)
+	assert.Equal(t, "Bearer tok1", requests[2].Header.Get("Authorization"))
+	assert.Equal(t, "Bearer tok2", requests[4].Header.Get("Authorization"))
+	retryBody, _ := io.ReadAll(requests[4].Body)
+	assert.Equal(t, "msg2", string(retryBody))
+
+	// token is reused until it expires
+	token, err := requestor.Token(http.DefaultClient)
+	assert.NoError(t, err)
+	assert.Equal(t, "tok2", token.AccessToken)
+	assert.Equal(t, time.Date(2024, 7, 10, 13, 0, 0, 0, time.UTC), token.Expiry)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2024, 7, 10, 13, 0, 0, 0, time.UTC)))
+
+	response, err = send("msg3")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "Bearer tok3", mocks.Requests()[6].Header.Get("Authorization"))
+
+	// tokens and secret can be redacted from logs
+	redact := requestor.Redactor("****")
+	assert.Equal(t, "Authorization: Bearer ****, ****, **** (****)", redact("Authorization: Bearer tok1, tok2, tok3 (sesame)"))
+
+	// token endpoint errors are returned
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2024, 7, 10, 15, 0, 0, 0, time.UTC)))
+
+	_, err = send("msg4")
+	assert.EqualError(t, err, "error requesting OAuth token: invalid_client")
+}
+
+func TestOAuthRequestorRefreshToken(t *testing.T) {
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://auth.temba.io/token": {
+			httpx.NewMockResponse(200, nil, []byte(`{"access_token": "tok1", "refresh_token": "ref2"}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{"access_token": "tok2"}`)),
+		},
+		"https://api.temba.io/": {
+			httpx.NewMockResponse(401, nil, []byte(`expired`)),
+			httpx.NewMockResponse(401, nil, []byte(`still expired`)),
+		},
+	})
+
+	requestor := httpx.NewOAuthRequestor(mocks, &httpx.OAuthConfig{TokenURL: "https://auth.temba.io/token", ClientID: "acme", ClientSecret: "sesame", RefreshToken: "ref1"})
+
+	request, _ := httpx.NewRequest("GET", "https://api.temba.io/", nil, nil)
+	response, err := requestor.Do(http.DefaultClient, request)
+	assert.NoError(t, err)
+
+	// we only retry once
+	assert.Equal(t, 401, response.StatusCode)
+	assert.False(t, mocks.HasUnused())
+
+	requests := mocks.Requests()
+	body, _ := io.ReadAll(requests[0].Body)
+	assert.Equal(t, "grant_type=refresh_token&refresh_token=ref1", string(body))
+	body, _ = io.ReadAll(requests[2].Body)
+	assert.Equal(t, "grant_type=refresh_token&refresh_token=ref2", string(body))
+
+	assert.Equal(t, "**** **** **** ****", requestor.Redactor("****")("ref1 ref2 tok1 tok2"))
+}
@@ -0,0 +1,172 @@
+package httpx
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultSanitizerHeaders are the headers whose values are masked by default
+var DefaultSanitizerHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key", "X-Auth-Token", "X-Access-Token"}
+
+// DefaultSanitizerQueryParams are the query parameters whose values are masked by default
+var DefaultSanitizerQueryParams = []string{"access_token", "refresh_token", "id_token", "token", "api_key", "apikey", "key", "client_secret", "secret", "password", "signature", "sig", "auth"}
+
+// DefaultSanitizerKeys matches the JSON fields whose values are masked by default
+var DefaultSanitizerKeys = regexp.MustCompile(`(?i)(password|passwd|secret|token|api[_-]?key|credential)`)
+
+// Sanitizer masks credentials in HTTP traces and URLs without needing to know their values up front. Header and query
+// parameter values are masked if their names are in the configured lists (case insensitive) or match the key pattern.
+// JSON string, number and boolean values are masked if their field names match the key pattern.
+type Sanitizer struct {
+	Mask        string
+	Headers     []string
+	QueryParams []string
+	Keys        *regexp.Regexp
+}
+
+// NewSanitizer creates a new sanitizer with the default headers, query parameters and key pattern
+func NewSanitizer(mask string) *Sanitizer {
+	return &Sanitizer{
+		Mask:        mask,
+		Headers:     DefaultSanitizerHeaders,
+		QueryParams: DefaultSanitizerQueryParams,
+		Keys:        DefaultSanitizerKeys,
+	}
+}
+
+// Sanitize masks credentials in the given request or response trace, or URL. It can be used as a stringsx.Redactor,
+// e.g. when creating logs with NewLog.
+func (s *Sanitizer) Sanitize(v string) string {
+	// anything without a line break is treated as a URL
+	if !strings.Contains(v, "\r\n") {
+		return s.sanitizeURL(v)
+	}
+
+	head, body, hasBody := strings.Cut(v, "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	isForm := false
+
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = s.sanitizeStartLine(line)
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if s.isSecretHeader(name) {
+			lines[i] = name + ": " + s.maskCredential(strings.TrimSpace(value))
+		} else if strings.EqualFold(name, "Content-Type") && strings.Contains(value, "application/x-www-form-urlencoded") {
+			isForm = true
+		}
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(strings.Join(lines, "\r\n"))
+
+	if hasBody {
+		b.WriteString("\r\n\r\n")
+
+		if isForm {
+			b.WriteString(s.sanitizeQuery(body))
+		} else {
+			b.WriteString(s.sanitizeJSON(body))
+		}
+	}
+
+	return b.String()
+}
+
+// sanitizes the request line of a request trace, e.g. GET /foo?token=1234 HTTP/1.1
+func (s *Sanitizer) sanitizeStartLine(line string) string {
+	parts := strings.Split(line, " ")
+	if len(parts) == 3 && strings.HasPrefix(parts[2], "HTTP/") {
+		parts[1] = s.sanitizeURL(parts[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *Sanitizer) sanitizeURL(u string) string {
+	base, query, ok := strings.Cut(u, "?")
+	if !ok {
+		return u
+	}
+
+	// preserve any fragment
+	query, fragment, hasFragment := strings.Cut(query, "#")
+
+	sanitized := base + "?" + s.sanitizeQuery(query)
+	if hasFragment {
+		sanitized += "#" + fragment
+	}
+	return sanitized
+}
+
+// masks parameter values in a URL encoded query string, leaving everything else as is
+func (s *Sanitizer) sanitizeQuery(query string) string {
+	params := strings.Split(query, "&")
+
+	for i, param := range params {
+		name, _, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil && s.isSecretParam(unescaped) {
+			params[i] = name + "=" + s.Mask
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// matches a JSON field with a string, number, boolean or null value
+var jsonFieldRegex = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)("(?:[^"\\]|\\.)*"|-?\d[\d.eE+-]*|true|false|null)`)
+
+// masks field values in a JSON body by rewriting it in place, so that the rest of the body is unchanged
+func (s *Sanitizer) sanitizeJSON(body string) string {
+	trimmed := strings.TrimSpace(body)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return body
+	}
+
+	return jsonFieldRegex.ReplaceAllStringFunc(body, func(m string) string {
+		match := jsonFieldRegex.FindStringSubmatch(m)
+		key, sep, value := match[1], match[2], match[3]
+
+		if value == "null" || s.Keys == nil || !s.Keys.MatchString(key) {
+			return m
+		}
+
+		return `"` + key + `"` + sep + `"` + s.Mask + `"`
+	})
+}
+
+var authSchemes = []string{"Basic", "Bearer", "Digest", "Token", "HMAC"}
+
+// masks a credential, preserving the authentication scheme if there is one, e.g. Bearer ****
+func (s *Sanitizer) maskCredential(value string) string {
+	if scheme, _, ok := strings.Cut(value, " "); ok && containsFold(authSchemes, scheme) {
+		return scheme + " " + s.Mask
+	}
+	return s.Mask
+}
+
+func (s *Sanitizer) isSecretHeader(name string) bool {
+	return containsFold(s.Headers, name) || (s.Keys != nil && s.Keys.MatchString(name))
+}
+
+func (s *Sanitizer) isSecretParam(name string) bool {
+	return containsFold(s.QueryParams, name) || (s.Keys != nil && s.Keys.MatchString(name))
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package httpx_test
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizer(t *testing.T) {
+	s := httpx.NewSanitizer("****")
+
+	tcs := []struct {
+		input     string
+		sanitized string
+	}{
+		{"", ""},
+		{"http://temba.io/foo", "http://temba.io/foo"},
+		{"http://temba.io/foo?a=1&b=2#x", "http://temba.io/foo?a=1&b=2#x"},
+		{"http://temba.io/foo?a=1&access_token=sesame&API_KEY=123&b#x", "http://temba.io/foo?a=1&access_token=****&API_KEY=****&b#x"},
+		{"http://temba.io/foo?my%5Ftoken=1234", "http://temba.io/foo?my%5Ftoken=****"},
+		{
+			"GET /foo?token=1234&page=2 HTTP/1.1\r\nHost: temba.io\r\nAuthorization: Bearer sesame\r\nCookie: session=abc\r\nX-Api-Key: 1234\r\nX-Csrf-Token: 5678\r\nAccept: */*\r\n\r\n",
+			"GET /foo?token=****&page=2 HTTP/1.1\r\nHost: temba.io\r\nAuthorization: Bearer ****\r\nCookie: ****\r\nX-Api-Key: ****\r\nX-Csrf-Token: ****\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			"POST /login HTTP/1.1\r\nAuthorization: sesame\r\nContent-Type: application/json\r\n\r\n{\"username\": \"bob\", \"password\": \"sesame\", \"count\": 3, \"tokens\": [\"a\"], \"auth\": {\"client_secret\": 1234, \"api-key\": true, \"secret\": null, \"note\": \"my \\\"secret\\\"\"}}",
+			"POST /login HTTP/1.1\r\nAuthorization: ****\r\nContent-Type: application/json\r\n\r\n{\"username\": \"bob\", \"password\": \"****\", \"count\": 3, \"tokens\": [\"a\"], \"auth\": {\"client_secret\": \"****\", \"api-key\": \"****\", \"secret\": null, \"note\": \"my \\\"secret\\\"\"}}",
+		},
+		{
+			"POST /token HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\ngrant_type=refresh_token&refresh_token=abc&client_secret=def",
+			"POST /token HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\ngrant_type=refresh_token&refresh_token=****&client_secret=****",
+		},
+		{
+			"HTTP/1.1 200 OK\r\nSet-Cookie: session=abc; HttpOnly\r\nContent-Type: application/json\r\n\r\n[{\"access_token\":\"abc\",\"expires_in\":3600}]",
+			"HTTP/1.1 200 OK\r\nSet-Cookie: ****\r\nContent-Type: application/json\r\n\r\n[{\"access_token\":\"****\",\"expires_in\":3600}]",
+		},
+		{
+			"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nthe \"token\": \"abc\"",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nthe \"token\": \"abc\"",
+		},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.sanitized, s.Sanitize(tc.input), "sanitized mismatch for input: %s", tc.input)
+	}
+
+	// check everything is configurable
+	s = &httpx.Sanitizer{Mask: "XX", Headers: []string{"X-Secret"}, QueryParams: []string{"q"}, Keys: regexp.MustCompile(`^pin$`)}
+
+	assert.Equal(t, "http://temba.io/?q=XX&token=123", s.Sanitize("http://temba.io/?q=1&token=123"))
+	assert.Equal(t,
+		"GET / HTTP/1.1\r\nX-Secret: XX\r\nAuthorization: Bearer abc\r\n\r\n{\"pin\": \"XX\", \"password\": \"abc\"}",
+		s.Sanitize("GET / HTTP/1.1\r\nX-Secret: 123\r\nAuthorization: Bearer abc\r\n\r\n{\"pin\": 1234, \"password\": \"abc\"}"),
+	)
+}
+
+func TestSanitizerWithLogs(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://api.temba.io/send?key=sesame": {
+			httpx.NewMockResponse(200, nil, []byte(`{"id": 123, "token": "abc"}`)),
+		},
+	}))
+
+	req, err := httpx.NewRequest("POST", "https://api.temba.io/send?key=sesame", strings.NewReader(`{"text": "hi", "password": "123"}`), map[string]string{"Authorization": "Token 123456"})
+	require.NoError(t, err)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, -1)
+	require.NoError(t, err)
+
+	log := httpx.NewLog(trace, 2048, 10000, httpx.NewSanitizer("****").Sanitize)
+	assert.Equal(t, "https://api.temba.io/send?key=****", log.URL)
+	assert.Equal(t, "POST /send?key=**** HTTP/1.1\r\nHost: api.temba.io\r\nUser-Agent: Go-http-client/1.1\r\nContent-Length: 33\r\nAuthorization: Token ****\r\nAccept-Encoding: gzip\r\n\r\n{\"text\": \"hi\", \"password\": \"****\"}", log.Request)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 27\r\n\r\n{\"id\": 123, \"token\": \"****\"}", log.Response)
+}
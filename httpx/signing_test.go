@@ -0,0 +1,123 @@
+package httpx_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACSigner(t *testing.T) {
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2024, 7, 10, 12, 0, 0, 0, time.UTC)))
+
+	signer := httpx.NewHMACSigner("sesame", httpx.HMACSHA256, 5*time.Minute)
+
+	request, err := httpx.NewRequest("POST", "https://temba.io/webhook", strings.NewReader(`{"hello":"world"}`), nil)
+	require.NoError(t, err)
+
+	err = signer.Sign(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "1720612800", request.Header.Get("X-Timestamp"))
+	assert.Equal(t, "sha256=808984a6404e8ef088ce02a2b168d36fab1b2e5319f574c206fc89262defd68f", request.Header.Get("X-Signature"))
+
+	// body can still be read
+	body, _ := io.ReadAll(request.Body)
+	assert.Equal(t, `{"hello":"world"}`, string(body))
+
+	// requests without bodies can also be signed
+	request, _ = httpx.NewRequest("GET", "https://temba.io/webhook", nil, nil)
+	err = httpx.NewHMACSigner("sesame", httpx.HMACSHA1, 0).Sign(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha1=a9d8770e849b73bb37e10307bba84d347173662f", request.Header.Get("X-Signature"))
+}
+
+func TestHMACSignerMiddleware(t *testing.T) {
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	signer := httpx.NewHMACSigner("sesame", httpx.HMACSHA256, 5*time.Minute)
+
+	var received string
+	server := httptest.NewServer(signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	call := func(signWith *httpx.HMACSigner, signedAt time.Time, tamper func(*http.Request)) (int, string) {
+		received = ""
+
+		dates.SetNowSource(dates.NewFixedNowSource(signedAt))
+		request, _ := httpx.NewRequest("POST", server.URL, strings.NewReader(`{"hello":"world"}`), nil)
+		if signWith != nil {
+			require.NoError(t, signWith.Sign(request))
+		}
+		if tamper != nil {
+			tamper(request)
+		}
+		dates.SetNowSource(dates.DefaultNowSource)
+
+		response, err := httpx.Do(http.DefaultClient, request, nil, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	// valid signature
+	status, _ := call(signer, time.Now(), nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"hello":"world"}`, received)
+
+	// unsigned
+	status, body := call(nil, time.Now(), nil)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "request signature missing", body)
+	assert.Equal(t, "", received)
+
+	// signed with a different secret
+	status, body = call(httpx.NewHMACSigner("open", httpx.HMACSHA256, 0), time.Now(), nil)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "request signature invalid", body)
+
+	// signed with a different algorithm
+	status, body = call(httpx.NewHMACSigner("sesame", httpx.HMACSHA512, 0), time.Now(), nil)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "request signature invalid", body)
+
+	// body changed after signing
+	status, body = call(signer, time.Now(), func(r *http.Request) {
+		r.Body = io.NopCloser(strings.NewReader(`{"hello":"moon"}`))
+		r.ContentLength = 16
+	})
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "request signature invalid", body)
+
+	// signed too long ago
+	status, body = call(signer, time.Now().Add(-10*time.Minute), nil)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "request timestamp outside of allowed window", body)
+
+	// body too large to verify
+	signer.MaxBodyBytes = 10
+
+	status, body = call(signer, time.Now(), nil)
+	assert.Equal(t, 413, status)
+	assert.Equal(t, "request body too large", body)
+	assert.Equal(t, "", received)
+
+	// a body within the limit is fine
+	signer.MaxBodyBytes = 17
+
+	status, _ = call(signer, time.Now(), nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"hello":"world"}`, received)
+}
@@ -0,0 +1,138 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/gocommon/syncx"
+	"github.com/nyaruka/gocommon/uuids"
+)
+
+// how long a sink will wait for a batch of logs to be written
+const logSinkWriteTimeout = 30 * time.Second
+
+// LogWriter is something that batches of HTTP logs can be written to
+type LogWriter interface {
+	WriteLogs(ctx context.Context, logs []*Log) error
+}
+
+// LogSink queues HTTP logs and writes them in batches in the background
+type LogSink struct {
+	writer  LogWriter
+	batcher *syncx.Batcher[*Log]
+	onError func(error, []*Log)
+	dropped atomic.Int64
+}
+
+// NewLogSink creates a new log sink which writes to the given writer. Logs are written in batches of `maxItems` maximum
+// size, or when `maxAge` has passed since the oldest unwritten log was queued.
+func NewLogSink(writer LogWriter, maxItems int, maxAge time.Duration, bufferSize int, wg *sync.WaitGroup) *LogSink {
+	s := &LogSink{writer: writer, onError: func(error, []*Log) {}}
+	s.batcher = syncx.NewBatcher(s.write, maxItems, maxAge, bufferSize, wg)
+	return s
+}
+
+// OnError is called when a batch of logs couldn't be written
+func (s *LogSink) OnError(fn func(err error, logs []*Log)) { s.onError = fn }
+
+// Start starts this sink's background writing
+func (s *LogSink) Start() { s.batcher.Start() }
+
+// Queue queues the given log to be written without blocking. If the buffer is full or the sink has been stopped, the
+// log is dropped and syncx.ErrBatcherFull or syncx.ErrBatcherStopped returned. Returns the new free capacity.
+func (s *LogSink) Queue(log *Log) (int, error) {
+	capacity, err := s.batcher.TryQueue(log)
+	if err != nil {
+		s.dropped.Add(1)
+	}
+	return capacity, err
+}
+
+// QueueContext queues the given log to be written, blocking until there is room or the context is done. If the log
+// can't be queued, it is dropped and the error returned. Returns the new free capacity.
+func (s *LogSink) QueueContext(ctx context.Context, log *Log) (int, error) {
+	capacity, err := s.batcher.QueueContext(ctx, log)
+	if err != nil {
+		s.dropped.Add(1)
+	}
+	return capacity, err
+}
+
+// Dropped returns the number of logs which have been dropped because they couldn't be queued
+func (s *LogSink) Dropped() int64 { return s.dropped.Load() }
+
+// Stop stops this sink, writing any logs that are still queued
+func (s *LogSink) Stop() { s.batcher.Stop() }
+
+func (s *LogSink) write(batch []*Log) {
+	ctx, cancel := context.WithTimeout(context.Background(), logSinkWriteTimeout)
+	defer cancel()
+
+	if err := s.writer.WriteLogs(ctx, batch); err != nil {
+		s.onError(err, batch)
+	}
+}
+
+// StorageLogWriter writes each batch of HTTP logs as a newline-delimited JSON file in a storage service. Files are
+// named <prefix>/<yyyy>/<mm>/<dd>/<uuid>.jsonl using the date that the batch was written.
+type StorageLogWriter struct {
+	storage storage.Storage
+	prefix  string
+}
+
+// NewStorageLogWriter creates a new writer which writes to the given storage service
+func NewStorageLogWriter(s storage.Storage, prefix string) *StorageLogWriter {
+	return &StorageLogWriter{storage: s, prefix: prefix}
+}
+
+func (w *StorageLogWriter) WriteLogs(ctx context.Context, logs []*Log) error {
+	body := &bytes.Buffer{}
+	for _, l := range logs {
+		body.Write(jsonx.MustMarshal(l))
+		body.WriteByte('\n')
+	}
+
+	path := fmt.Sprintf("%s/%s/%s.jsonl", w.prefix, dates.Now().UTC().Format("2006/01/02"), uuids.New())
+
+	if _, err := w.storage.Put(ctx, path, "application/x-ndjson", body.Bytes()); err != nil {
+		return fmt.Errorf("error writing logs to %s: %w", w.storage.Name(), err)
+	}
+	return nil
+}
+
+// SlogLogWriter emits HTTP logs as structured log records
+type SlogLogWriter struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+// NewSlogLogWriter creates a new writer which emits to the given logger at the given level
+func NewSlogLogWriter(logger *slog.Logger, level slog.Level) *SlogLogWriter {
+	return &SlogLogWriter{logger: logger, level: level}
+}
+
+func (w *SlogLogWriter) WriteLogs(ctx context.Context, logs []*Log) error {
+	for _, l := range logs {
+		w.logger.LogAttrs(ctx, w.level, "http request",
+			slog.String("url", l.URL),
+			slog.Int("status_code", l.StatusCode),
+			slog.Int("elapsed_ms", l.ElapsedMS),
+			slog.Int("retries", l.Retries),
+			slog.Time("created_on", l.CreatedOn),
+			slog.String("request", l.Request),
+			slog.String("response", l.Response),
+		)
+	}
+	return nil
+}
+
+var _ LogWriter = (*StorageLogWriter)(nil)
+var _ LogWriter = (*SlogLogWriter)(nil)
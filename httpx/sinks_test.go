@@ -0,0 +1,174 @@
+package httpx_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/gocommon/syncx"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLog(url string, statusCode int, createdOn time.Time) *httpx.Log {
+	return &httpx.Log{
+		LogWithoutTime: &httpx.LogWithoutTime{
+			URL:        url,
+			StatusCode: statusCode,
+			Request:    "GET / HTTP/1.1\r\n\r\n",
+			Response:   "HTTP/1.1 200 OK\r\n\r\n",
+			ElapsedMS:  12,
+			Retries:    1,
+		},
+		CreatedOn: createdOn,
+	}
+}
+
+type testLogWriter struct {
+	mutex   sync.Mutex
+	batches [][]*httpx.Log
+	err     error
+}
+
+func (w *testLogWriter) WriteLogs(ctx context.Context, logs []*httpx.Log) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.batches = append(w.batches, logs)
+	return w.err
+}
+
+func TestLogSink(t *testing.T) {
+	t1 := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	writer := &testLogWriter{}
+	wg := &sync.WaitGroup{}
+
+	sink := httpx.NewLogSink(writer, 2, time.Second, 10, wg)
+	sink.Start()
+
+	sink.Queue(newTestLog("http://temba.io/1", 200, t1))
+	sink.Queue(newTestLog("http://temba.io/2", 200, t1))
+	_, err := sink.QueueContext(context.Background(), newTestLog("http://temba.io/3", 200, t1))
+	assert.NoError(t, err)
+
+	sink.Stop()
+	wg.Wait()
+
+	// logs queued after stopping are dropped rather than panicking
+	_, err = sink.Queue(newTestLog("http://temba.io/4", 200, t1))
+	assert.Equal(t, syncx.ErrBatcherStopped, err)
+	_, err = sink.QueueContext(context.Background(), newTestLog("http://temba.io/5", 200, t1))
+	assert.Equal(t, syncx.ErrBatcherStopped, err)
+	assert.Equal(t, int64(2), sink.Dropped())
+
+	require.Len(t, writer.batches, 2)
+	assert.Len(t, writer.batches[0], 2)
+	assert.Len(t, writer.batches[1], 1)
+	assert.Equal(t, "http://temba.io/3", writer.batches[1][0].URL)
+
+	// check errors are passed to the callback with the batch
+	writer = &testLogWriter{err: errors.New("boom")}
+	var errs []error
+	var failed []*httpx.Log
+
+	sink = httpx.NewLogSink(writer, 2, time.Second, 10, wg)
+	sink.OnError(func(err error, logs []*httpx.Log) {
+		errs = append(errs, err)
+		failed = append(failed, logs...)
+	})
+	sink.Start()
+	sink.Queue(newTestLog("http://temba.io/1", 200, t1))
+	sink.Stop()
+	wg.Wait()
+
+	assert.Equal(t, []error{errors.New("boom")}, errs)
+	assert.Len(t, failed, 1)
+
+	// logs are dropped if the buffer is full
+	block := make(chan bool)
+	sink = httpx.NewLogSink(&blockingLogWriter{block}, 1, time.Second, 1, wg)
+	sink.Start()
+
+	_, err = sink.Queue(newTestLog("http://temba.io/1", 200, t1)) // taken by writing which blocks
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = sink.Queue(newTestLog("http://temba.io/2", 200, t1)) // fills the buffer
+	assert.NoError(t, err)
+	_, err = sink.Queue(newTestLog("http://temba.io/3", 200, t1))
+	assert.Equal(t, syncx.ErrBatcherFull, err)
+	assert.Equal(t, int64(1), sink.Dropped())
+
+	close(block)
+	sink.Stop()
+	wg.Wait()
+}
+
+type blockingLogWriter struct {
+	block chan bool
+}
+
+func (w *blockingLogWriter) WriteLogs(ctx context.Context, logs []*httpx.Log) error {
+	<-w.block
+	return nil
+}
+
+func TestStorageLogWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	defer dates.SetNowSource(dates.DefaultNowSource)
+	defer uuids.SetGenerator(uuids.DefaultGenerator)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)))
+	uuids.SetGenerator(uuids.NewSeededGenerator(1234))
+
+	t1 := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	writer := httpx.NewStorageLogWriter(storage.NewFS(dir, 0766), "logs")
+
+	err := writer.WriteLogs(ctx, []*httpx.Log{newTestLog("http://temba.io/1", 200, t1), newTestLog("http://temba.io/2", 503, t1)})
+	assert.NoError(t, err)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "logs", "2024", "05", "01", "*.jsonl"))
+	require.Len(t, files, 1)
+
+	contents, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, `{"url":"http://temba.io/1","status_code":200,"request":"GET / HTTP/1.1\r\n\r\n","response":"HTTP/1.1 200 OK\r\n\r\n","elapsed_ms":12,"retries":1,"created_on":"2024-05-01T12:30:00Z"}
+{"url":"http://temba.io/2","status_code":503,"request":"GET / HTTP/1.1\r\n\r\n","response":"HTTP/1.1 200 OK\r\n\r\n","elapsed_ms":12,"retries":1,"created_on":"2024-05-01T12:30:00Z"}
+`, string(contents))
+}
+
+func TestSlogLogWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	t1 := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	writer := httpx.NewSlogLogWriter(logger, slog.LevelInfo)
+
+	err := writer.WriteLogs(context.Background(), []*httpx.Log{newTestLog("http://temba.io/1", 200, t1)})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"level":"INFO","msg":"http request","url":"http://temba.io/1","status_code":200,"elapsed_ms":12,"retries":1,"created_on":"2024-05-01T12:30:00Z","request":"GET / HTTP/1.1\r\n\r\n","response":"HTTP/1.1 200 OK\r\n\r\n"}`+"\n", out.String())
+
+	// nothing emitted if logger level is higher
+	out.Reset()
+	writer = httpx.NewSlogLogWriter(logger, slog.LevelDebug)
+	assert.NoError(t, writer.WriteLogs(context.Background(), []*httpx.Log{newTestLog("http://temba.io/1", 200, t1)}))
+	assert.Equal(t, "", out.String())
+}
@@ -0,0 +1,194 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/storage"
+)
+
+// ErrIncompleteBody is the error a spool is closed with if the body wasn't read completely
+var ErrIncompleteBody = errors.New("response body not read completely")
+
+// DoTraceStreamed makes the given request like DoTrace but rather than reading the response body itself, it returns
+// the body for the caller to read and close. As the body is read, the first `maxTraceBytes` (or all if zero or less)
+// are captured in the trace's response body, and everything is written to `spool` if it's non-nil. The trace's end
+// time is set when the body is closed, which also closes the spool. If the body wasn't read to the end without error,
+// and the spool has a CloseWithError method like StorageSpool, the spool is closed with that error instead.
+func DoTraceStreamed(client *http.Client, request *http.Request, retries *RetryConfig, access *AccessConfig, maxTraceBytes int, spool io.WriteCloser) (*Trace, io.ReadCloser, error) {
+	requestTrace, err := httputil.DumpRequestOut(request, true)
+	if err != nil {
+		closeSpool(spool, err)
+		return nil, nil, err
+	}
+
+	trace := &Trace{
+		Request:      request,
+		RequestTrace: requestTrace,
+		StartTime:    dates.Now(),
+	}
+
+	response, retryCount, err := do(client, request, retries, access)
+	trace.Response = response
+	trace.Retries = retryCount
+	trace.CacheHit = isCacheHit(response)
+
+	if err != nil {
+		trace.EndTime = dates.Now()
+		closeSpool(spool, err)
+		return trace, nil, err
+	}
+
+	trace.ResponseTrace, err = httputil.DumpResponse(response, false)
+	if err != nil {
+		trace.EndTime = dates.Now()
+		response.Body.Close()
+		closeSpool(spool, err)
+		return trace, nil, err
+	}
+
+	return trace, &tracedBody{trace: trace, body: response.Body, maxTraceBytes: maxTraceBytes, spool: spool}, nil
+}
+
+// a spool which can be told that the body is incomplete
+type errorCloser interface {
+	CloseWithError(err error) error
+}
+
+// closes the given spool, with the given error if it's non-nil and the spool supports that
+func closeSpool(spool io.WriteCloser, cause error) error {
+	if spool == nil {
+		return nil
+	}
+	if ec, ok := spool.(errorCloser); ok && cause != nil {
+		return ec.CloseWithError(cause)
+	}
+	return spool.Close()
+}
+
+// response body which tees what is read into a trace and a spool
+type tracedBody struct {
+	trace         *Trace
+	body          io.ReadCloser
+	maxTraceBytes int
+	traced        bytes.Buffer
+	spool         io.WriteCloser
+	closed        bool
+	eof           bool
+	readErr       error
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+
+	if n > 0 {
+		toTrace := n
+		if b.maxTraceBytes > 0 {
+			toTrace = min(n, b.maxTraceBytes-b.traced.Len())
+		}
+		if toTrace > 0 {
+			b.traced.Write(p[:toTrace])
+			b.trace.ResponseBody = b.traced.Bytes()
+		}
+
+		if b.spool != nil {
+			if _, werr := b.spool.Write(p[:n]); werr != nil {
+				b.readErr = werr
+				return n, werr
+			}
+		}
+	}
+
+	if err == io.EOF {
+		b.eof = true
+	} else if err != nil {
+		b.readErr = err
+	}
+
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.trace.EndTime = dates.Now()
+
+	// the caller may have read all the content without reading the EOF, so check if there's anything left
+	if b.spool != nil && !b.eof && b.readErr == nil {
+		if n, err := b.body.Read(make([]byte, 1)); n == 0 && err == io.EOF {
+			b.eof = true
+		}
+	}
+
+	err := b.body.Close()
+
+	var cause error
+	if b.readErr != nil {
+		cause = b.readErr
+	} else if !b.eof {
+		cause = ErrIncompleteBody
+	}
+
+	if serr := closeSpool(b.spool, cause); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// StorageSpool is a spool for DoTraceStreamed which saves the body to a storage when closed, unless the body is
+// incomplete
+type StorageSpool struct {
+	ctx         context.Context
+	storage     storage.Storage
+	path        string
+	contentType string
+	buffer      bytes.Buffer
+
+	// set when spool is closed
+	URL string
+}
+
+// NewStorageSpool creates a new spool which will save to the given path in the given storage. If content type is
+// empty, it will be detected from the body.
+func NewStorageSpool(ctx context.Context, s storage.Storage, path, contentType string) *StorageSpool {
+	return &StorageSpool{ctx: ctx, storage: s, path: path, contentType: contentType}
+}
+
+func (s *StorageSpool) Write(p []byte) (int, error) {
+	return s.buffer.Write(p)
+}
+
+// Close saves the spooled body to storage
+func (s *StorageSpool) Close() error {
+	body := s.buffer.Bytes()
+
+	contentType := s.contentType
+	if contentType == "" {
+		contentType, _ = DetectContentType(body)
+	}
+
+	url, err := s.storage.Put(s.ctx, s.path, contentType, body)
+	if err != nil {
+		return err
+	}
+
+	s.URL = url
+	return nil
+}
+
+// CloseWithError discards the spooled body without saving it, returning an error wrapping the given cause
+func (s *StorageSpool) CloseWithError(cause error) error {
+	s.buffer.Reset()
+	return fmt.Errorf("body not saved to %s: %w", s.path, cause)
+}
+
+var _ io.WriteCloser = (*StorageSpool)(nil)
@@ -0,0 +1,143 @@
+package httpx_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoTraceStreamed(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewSequentialNowSource(time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC)))
+
+	testBody := []byte(`abcdefghijklmnopqrstuvwxyz`)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://temba.io/file.txt": {
+			httpx.NewMockResponse(200, nil, testBody),
+			httpx.NewMockResponse(200, nil, testBody),
+			httpx.NewMockResponse(200, nil, testBody),
+			httpx.NewMockResponse(200, nil, testBody),
+		},
+		"https://temba.io/error": {
+			httpx.MockConnectionError,
+		},
+	}))
+
+	// stream with a trace limit and no spool
+	request, _ := httpx.NewRequest("GET", "https://temba.io/file.txt", nil, nil)
+	trace, body, err := httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, 10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 26\r\n\r\n", string(trace.ResponseTrace))
+	assert.Nil(t, trace.ResponseBody)
+	assert.True(t, trace.EndTime.IsZero())
+
+	read, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, testBody, read)
+	assert.Equal(t, "abcdefghij", string(trace.ResponseBody))
+	assert.Equal(t, time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC), trace.StartTime)
+	assert.Equal(t, time.Date(2019, 10, 7, 15, 21, 31, 0, time.UTC), trace.EndTime)
+
+	// stream with no trace limit and spooling to a temp file
+	spoolFile, err := os.CreateTemp(t.TempDir(), "spool")
+	require.NoError(t, err)
+
+	request, _ = httpx.NewRequest("GET", "https://temba.io/file.txt", nil, nil)
+	trace, body, err = httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, -1, spoolFile)
+	require.NoError(t, err)
+
+	read, _ = io.ReadAll(body)
+	body.Close()
+	assert.Equal(t, testBody, read)
+	assert.Equal(t, testBody, trace.ResponseBody)
+
+	spooled, err := os.ReadFile(spoolFile.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, testBody, spooled)
+
+	// stream and spool to storage
+	storageDir := t.TempDir()
+	spool := httpx.NewStorageSpool(context.Background(), storage.NewFS(storageDir, 0766), "attachments/file.txt", "")
+
+	request, _ = httpx.NewRequest("GET", "https://temba.io/file.txt", nil, nil)
+	trace, body, err = httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, 5, spool)
+	require.NoError(t, err)
+
+	read, _ = io.ReadAll(body)
+	assert.NoError(t, body.Close())
+	assert.NoError(t, body.Close()) // closing again is a noop
+	assert.Equal(t, testBody, read)
+	assert.Equal(t, "abcde", string(trace.ResponseBody))
+	assert.Equal(t, filepath.Join(storageDir, "attachments/file.txt"), spool.URL)
+
+	spooled, err = os.ReadFile(spool.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, testBody, spooled)
+
+	// if the body isn't read to the end, it isn't saved to storage
+	spool = httpx.NewStorageSpool(context.Background(), storage.NewFS(storageDir, 0766), "attachments/partial.txt", "")
+
+	request, _ = httpx.NewRequest("GET", "https://temba.io/file.txt", nil, nil)
+	_, body, err = httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, 5, spool)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(body, make([]byte, 10))
+	assert.NoError(t, err)
+	err = body.Close()
+	assert.EqualError(t, err, "body not saved to attachments/partial.txt: response body not read completely")
+	assert.ErrorIs(t, err, httpx.ErrIncompleteBody)
+	assert.Equal(t, "", spool.URL)
+	assert.NoFileExists(t, filepath.Join(storageDir, "attachments/partial.txt"))
+
+	// connection errors return a trace without a response or body
+	request, _ = httpx.NewRequest("GET", "https://temba.io/error", nil, nil)
+	trace, body, err = httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, 10, nil)
+	assert.EqualError(t, err, "unable to connect to server")
+	assert.Nil(t, body)
+	assert.Nil(t, trace.Response)
+	assert.False(t, trace.EndTime.IsZero())
+}
+
+func TestDoTraceStreamedReadError(t *testing.T) {
+	// server which sends less of the body than its content length says
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("only part of the body"))
+		w.(http.Flusher).Flush()
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	storageDir := t.TempDir()
+	spool := httpx.NewStorageSpool(context.Background(), storage.NewFS(storageDir, 0766), "attachments/file.txt", "")
+
+	request, _ := httpx.NewRequest("GET", server.URL, nil, nil)
+	_, body, err := httpx.DoTraceStreamed(http.DefaultClient, request, nil, nil, -1, spool)
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	err = body.Close()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "", spool.URL)
+	assert.NoFileExists(t, filepath.Join(storageDir, "attachments/file.txt"))
+}
@@ -1,33 +1,163 @@
 package httpx
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nyaruka/gocommon/analytics"
+	"github.com/nyaruka/gocommon/stringsx"
 )
 
 const (
 	// max time for between reading a message before socket is considered closed
-	maxReadWait = 60 * time.Second
+	defaultMaxReadWait = 60 * time.Second
 
 	// maximum time to wait for message to be written
-	maxWriteWait = 15 * time.Second
+	defaultMaxWriteWait = 15 * time.Second
 
 	// how often to send a ping message
-	pingPeriod = 30 * time.Second
+	defaultPingPeriod = 30 * time.Second
 
 	// maximum time to wait for writer to drain when closing
-	drainPeriod = 3 * time.Second
+	defaultDrainPeriod = 3 * time.Second
+
+	// default sizes of the read and write buffers
+	defaultBufferSize = 1024
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// WebSocketOptions configures a new web socket. Zero values for timings and buffer sizes mean the defaults are used.
+type WebSocketOptions struct {
+	MaxReadBytes int64
+	SendBuffer   int
+
+	MaxReadWait  time.Duration // max time between reading messages before socket is considered closed
+	MaxWriteWait time.Duration // max time to wait for a message to be written
+	PingPeriod   time.Duration // how often to send a ping message
+	DrainPeriod  time.Duration // max time to wait for writer to drain when closing
+
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// origins allowed to connect, which can use * globs, e.g. *.textit.com, and if empty all origins are allowed
+	AllowedOrigins []string
+
+	// supported subprotocols in order of preference
+	Subprotocols []string
+
+	// whether to negotiate permessage-deflate compression with clients
+	EnableCompression bool
+
+	// what happens when sending to a socket whose outbox is full
+	SendPolicy SendPolicy
+
+	// if set, ping latencies and traffic are recorded as analytics gauges with this prefix, where traffic values are the
+	// amounts since the socket's previous report, sent every ping period and on close, so should be summed
+	AnalyticsPrefix string
+}
+
+// NewWebSocketOptions creates new web socket options with the default timings
+func NewWebSocketOptions(maxReadBytes int64, sendBuffer int) *WebSocketOptions {
+	return &WebSocketOptions{
+		MaxReadBytes:    maxReadBytes,
+		SendBuffer:      sendBuffer,
+		MaxReadWait:     defaultMaxReadWait,
+		MaxWriteWait:    defaultMaxWriteWait,
+		PingPeriod:      defaultPingPeriod,
+		DrainPeriod:     defaultDrainPeriod,
+		ReadBufferSize:  defaultBufferSize,
+		WriteBufferSize: defaultBufferSize,
+	}
+}
+
+// returns a copy of these options with defaults for any unset values
+func (o *WebSocketOptions) withDefaults() *WebSocketOptions {
+	c := *o
+	if c.MaxReadWait <= 0 {
+		c.MaxReadWait = defaultMaxReadWait
+	}
+	if c.MaxWriteWait <= 0 {
+		c.MaxWriteWait = defaultMaxWriteWait
+	}
+	if c.PingPeriod <= 0 {
+		c.PingPeriod = defaultPingPeriod
+	}
+	if c.DrainPeriod <= 0 {
+		c.DrainPeriod = defaultDrainPeriod
+	}
+	if c.ReadBufferSize <= 0 {
+		c.ReadBufferSize = defaultBufferSize
+	}
+	if c.WriteBufferSize <= 0 {
+		c.WriteBufferSize = defaultBufferSize
+	}
+	return &c
+}
+
+// checks the origin of the given request against the allowed origins, allowing requests without an origin, which
+// won't be from browsers
+func (o *WebSocketOptions) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(o.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	for _, allowed := range o.AllowedOrigins {
+		if stringsx.GlobMatch(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrSocketClosed is returned when trying to send to a socket which is closed or closing
+var ErrSocketClosed = errors.New("socket is closed or closing")
+
+// ErrSocketOutboxFull is returned when a socket using the SendDisconnect policy is disconnected because its outbox is full
+var ErrSocketOutboxFull = errors.New("socket outbox is full")
+
+// SendPolicy determines what happens when sending to a socket whose outbox is full
+type SendPolicy int
+
+const (
+	// SendBlock blocks until there is room in the outbox, the socket closes, or the send context is done
+	SendBlock SendPolicy = iota
+
+	// SendDropOldest discards the oldest message in the outbox to make room
+	SendDropOldest
+
+	// SendDisconnect closes the socket with a policy violation code
+	SendDisconnect
+)
 
-	// responsibility of caller to enforce origin rules
-	CheckOrigin: func(r *http.Request) bool { return true },
+// WebSocketStats are counts of the traffic over a web socket
+type WebSocketStats struct {
+	MessagesIn      int64         // messages received
+	MessagesOut     int64         // messages written
+	MessagesDropped int64         // messages discarded because the outbox was full
+	BytesIn         int64         // bytes of messages received
+	BytesOut        int64         // bytes of messages written
+	QueueDepth      int           // messages waiting to be written
+	PingLatency     time.Duration // round trip time of the last ping, or zero if none has been answered
+}
+
+// Add returns the sum of these stats and the given stats, taking the larger of the two ping latencies
+func (s WebSocketStats) Add(o WebSocketStats) WebSocketStats {
+	latency := max(s.PingLatency, o.PingLatency)
+
+	return WebSocketStats{
+		MessagesIn:      s.MessagesIn + o.MessagesIn,
+		MessagesOut:     s.MessagesOut + o.MessagesOut,
+		MessagesDropped: s.MessagesDropped + o.MessagesDropped,
+		BytesIn:         s.BytesIn + o.BytesIn,
+		BytesOut:        s.BytesOut + o.BytesOut,
+		QueueDepth:      s.QueueDepth + o.QueueDepth,
+		PingLatency:     latency,
+	}
 }
 
 // WebSocket provides a websocket interface similar to that of Javascript.
@@ -35,9 +165,16 @@ type WebSocket interface {
 	// Start begins reading and writing of messages on this socket
 	Start()
 
-	// Send sends the given message over the socket
+	// Send sends the given text message over the socket, panicking if the socket is closed or closing
 	Send([]byte)
 
+	// SendContext sends the given text message over the socket, returning an error if the socket is closed or closing,
+	// or the message couldn't be queued before the context is done
+	SendContext(context.Context, []byte) error
+
+	// SendBinary is the same as SendContext but sends a binary message
+	SendBinary(context.Context, []byte) error
+
 	// Close closes the socket connection
 	Close(int)
 
@@ -46,6 +183,12 @@ type WebSocket interface {
 
 	// OnClose is called when the socket is closed (even if we initiate the close)
 	OnClose(func(int))
+
+	// Subprotocol returns the negotiated subprotocol or empty string if there isn't one
+	Subprotocol() string
+
+	// Stats returns the traffic stats for this socket
+	Stats() WebSocketStats
 }
 
 type message struct {
@@ -55,14 +198,31 @@ type message struct {
 
 // WebSocket implemention using gorilla library
 type socket struct {
-	conn   *websocket.Conn
-	outbox chan message
-
-	readError       chan error
-	writeError      chan error
-	shutdown        chan bool
-	stopWriter      chan bool
+	conn    *websocket.Conn
+	outbox  chan message
+	options *WebSocketOptions
+
+	readError  chan error
+	writeError chan error
+	shutdown   chan bool
+	stopWriter chan bool
+
+	// closing is closed when the socket starts closing, and closeFrame is set if we initiated that
+	mutex           sync.Mutex
+	closing         chan struct{}
+	isClosing       bool
 	closingWithCode int
+	closeFrame      bool
+	started         bool
+
+	messagesIn      atomic.Int64
+	messagesOut     atomic.Int64
+	messagesDropped atomic.Int64
+	bytesIn         atomic.Int64
+	bytesOut        atomic.Int64
+	pingSentOn      atomic.Int64 // unix nanos of last unanswered ping
+	pingLatency     atomic.Int64
+	reported        WebSocketStats // traffic already recorded to analytics, only used by writer and then monitor
 
 	readerWaitGroup  sync.WaitGroup
 	writerWaitGroup  sync.WaitGroup
@@ -72,94 +232,213 @@ type socket struct {
 	onClose   func(int)
 }
 
-// NewWebSocket creates a new web socket from a regular HTTP request
+// NewWebSocket creates a new web socket from a regular HTTP request, using the default timings and accepting all origins
 func NewWebSocket(w http.ResponseWriter, r *http.Request, maxReadBytes int64, sendBuffer int) (WebSocket, error) {
+	return NewWebSocketWithOptions(w, r, NewWebSocketOptions(maxReadBytes, sendBuffer))
+}
+
+// NewWebSocketWithOptions creates a new web socket from a regular HTTP request with the given options
+func NewWebSocketWithOptions(w http.ResponseWriter, r *http.Request, options *WebSocketOptions) (WebSocket, error) {
+	options = options.withDefaults()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		Subprotocols:      options.Subprotocols,
+		EnableCompression: options.EnableCompression,
+		CheckOrigin:       options.checkOrigin,
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	conn.SetReadLimit(maxReadBytes)
+	return newSocket(conn, options), nil
+}
+
+func newSocket(conn *websocket.Conn, options *WebSocketOptions) *socket {
+	conn.SetReadLimit(options.MaxReadBytes)
 
 	return &socket{
-		conn:   conn,
-		outbox: make(chan message, sendBuffer),
+		conn:    conn,
+		outbox:  make(chan message, options.SendBuffer),
+		options: options,
 
 		readError:  make(chan error, 1),
 		writeError: make(chan error, 1),
 		shutdown:   make(chan bool, 1),
 		stopWriter: make(chan bool),
+		closing:    make(chan struct{}),
 
 		onMessage: defaultOnMessage,
 		onClose:   defaultOnClose,
-	}, nil
+	}
 }
 
 func (s *socket) OnMessage(fn func([]byte)) { s.onMessage = fn }
 func (s *socket) OnClose(fn func(int))      { s.onClose = fn }
+func (s *socket) Subprotocol() string       { return s.conn.Subprotocol() }
+
+func (s *socket) Stats() WebSocketStats {
+	return WebSocketStats{
+		MessagesIn:      s.messagesIn.Load(),
+		MessagesOut:     s.messagesOut.Load(),
+		MessagesDropped: s.messagesDropped.Load(),
+		BytesIn:         s.bytesIn.Load(),
+		BytesOut:        s.bytesOut.Load(),
+		QueueDepth:      len(s.outbox),
+		PingLatency:     time.Duration(s.pingLatency.Load()),
+	}
+}
 
 func (s *socket) Start() {
-	if s.closingWithCode != 0 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isClosing || s.started {
 		panic("can't start socket which is closed or closing")
 	}
+	s.started = true
 
-	s.conn.SetReadDeadline(time.Now().Add(maxReadWait))
+	s.conn.SetReadDeadline(time.Now().Add(s.options.MaxReadWait))
 	s.conn.SetPongHandler(s.pong)
 
+	s.monitorWaitGroup.Add(1)
+	s.readerWaitGroup.Add(1)
+	s.writerWaitGroup.Add(1)
+
 	go s.monitor()
 	go s.reader()
 	go s.writer()
 }
 
 func (s *socket) Send(msg []byte) {
-	if s.closingWithCode != 0 {
+	if err := s.send(context.Background(), message{type_: websocket.TextMessage, data: msg}); err == ErrSocketClosed {
 		panic("can't send to socket which is closed or closing")
 	}
+}
+
+func (s *socket) SendContext(ctx context.Context, msg []byte) error {
+	return s.send(ctx, message{type_: websocket.TextMessage, data: msg})
+}
 
-	s.outbox <- message{type_: websocket.TextMessage, data: msg}
+func (s *socket) SendBinary(ctx context.Context, msg []byte) error {
+	return s.send(ctx, message{type_: websocket.BinaryMessage, data: msg})
+}
+
+func (s *socket) send(ctx context.Context, msg message) error {
+	select {
+	case <-s.closing:
+		return ErrSocketClosed
+	default:
+	}
+
+	switch s.options.SendPolicy {
+	case SendDropOldest:
+		for {
+			select {
+			case s.outbox <- msg:
+				return nil
+			case <-s.closing:
+				return ErrSocketClosed
+			default:
+				// outbox is full so discard the oldest message, unless the writer got to it first
+				select {
+				case <-s.outbox:
+					s.messagesDropped.Add(1)
+				default:
+				}
+			}
+		}
+
+	case SendDisconnect:
+		select {
+		case s.outbox <- msg:
+			return nil
+		case <-s.closing:
+			return ErrSocketClosed
+		default:
+			s.messagesDropped.Add(1)
+
+			// don't wait for close to complete as we may have been called from the reader
+			s.startClosing(websocket.ClosePolicyViolation, true)
+			return ErrSocketOutboxFull
+		}
+
+	default:
+		select {
+		case s.outbox <- msg:
+			return nil
+		case <-s.closing:
+			return ErrSocketClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (s *socket) Close(code int) {
-	if s.closingWithCode != 0 {
+	if !s.startClosing(code, true) {
 		panic("can't close socket which is already closed or closing")
 	}
 
-	s.closingWithCode = code
+	s.monitorWaitGroup.Wait()
+}
+
+// whether this socket has been started or has started closing
+func (s *socket) hasStarted() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	s.outbox <- message{type_: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, "")}
+	return s.started || s.isClosing
+}
 
-	s.shutdown <- true
+// marks this socket as closing, returning false if it was already closing
+func (s *socket) startClosing(code int, initiated bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	s.monitorWaitGroup.Wait()
+	if s.isClosing {
+		return false
+	}
+
+	s.isClosing = true
+	s.closingWithCode = code
+	s.closeFrame = initiated
+	close(s.closing)
+
+	if initiated {
+		s.shutdown <- true
+	}
+	return true
 }
 
 func (s *socket) pong(m string) error {
-	s.conn.SetReadDeadline(time.Now().Add(maxReadWait))
+	s.conn.SetReadDeadline(time.Now().Add(s.options.MaxReadWait))
+
+	if sentOn := s.pingSentOn.Swap(0); sentOn != 0 {
+		latency := time.Since(time.Unix(0, sentOn))
+		s.pingLatency.Store(int64(latency))
+
+		if s.options.AnalyticsPrefix != "" {
+			analytics.Gauge(s.options.AnalyticsPrefix+".ping_latency", float64(latency)/float64(time.Millisecond))
+		}
+	}
 
 	return nil
 }
 
 func (s *socket) monitor() {
-	s.monitorWaitGroup.Add(1)
 	defer s.monitorWaitGroup.Done()
 
 	// shutdown starts via read error, write error, or Close()
-out:
-	for {
-		select {
-		case err := <-s.readError:
-			if e, ok := err.(*websocket.CloseError); ok && s.closingWithCode == 0 {
-				s.closingWithCode = e.Code
-			}
-			break out
-		case err := <-s.writeError:
-			if e, ok := err.(*websocket.CloseError); ok && s.closingWithCode == 0 {
-				s.closingWithCode = e.Code
-			}
-			break out
-		case <-s.shutdown:
-			break out
-		}
+	select {
+	case err := <-s.readError:
+		s.startClosing(closeCode(err), false)
+	case err := <-s.writeError:
+		s.startClosing(closeCode(err), false)
+	case <-s.shutdown:
 	}
 
 	// stop writer if not already finished...
@@ -170,11 +449,41 @@ out:
 	s.conn.Close()
 	s.readerWaitGroup.Wait()
 
-	s.onClose(s.closingWithCode)
+	s.mutex.Lock()
+	code := s.closingWithCode
+	s.mutex.Unlock()
+
+	s.reportTraffic()
+
+	s.onClose(code)
+}
+
+// records traffic since the last report as analytics gauges
+func (s *socket) reportTraffic() {
+	prefix := s.options.AnalyticsPrefix
+	if prefix == "" {
+		return
+	}
+
+	stats, last := s.Stats(), s.reported
+	s.reported = stats
+
+	analytics.Gauge(prefix+".messages_in", float64(stats.MessagesIn-last.MessagesIn))
+	analytics.Gauge(prefix+".messages_out", float64(stats.MessagesOut-last.MessagesOut))
+	analytics.Gauge(prefix+".messages_dropped", float64(stats.MessagesDropped-last.MessagesDropped))
+	analytics.Gauge(prefix+".bytes_in", float64(stats.BytesIn-last.BytesIn))
+	analytics.Gauge(prefix+".bytes_out", float64(stats.BytesOut-last.BytesOut))
+}
+
+// gets the close code for an error, which is zero unless the error is a close message
+func closeCode(err error) int {
+	if e, ok := err.(*websocket.CloseError); ok {
+		return e.Code
+	}
+	return 0
 }
 
 func (s *socket) reader() {
-	s.readerWaitGroup.Add(1)
 	defer s.readerWaitGroup.Done()
 
 	for {
@@ -184,52 +493,87 @@ func (s *socket) reader() {
 			return
 		}
 
+		s.messagesIn.Add(1)
+		s.bytesIn.Add(int64(len(message)))
+
 		s.onMessage(message)
 	}
 }
 
 func (s *socket) writer() {
-	s.writerWaitGroup.Add(1)
 	defer s.writerWaitGroup.Done()
 
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(s.options.PingPeriod)
 	defer ticker.Stop()
 
 out:
 	for {
 		select {
 		case msg := <-s.outbox:
-			s.conn.SetWriteDeadline(time.Now().Add(maxWriteWait))
+			s.conn.SetWriteDeadline(time.Now().Add(s.options.MaxWriteWait))
 
-			if err := s.conn.WriteMessage(msg.type_, msg.data); err != nil {
-				s.writeError <- err
+			if err := s.write(msg); err != nil {
+				s.writeFailed(err)
 			}
 		case <-ticker.C:
-			s.conn.SetWriteDeadline(time.Now().Add(maxWriteWait))
+			s.conn.SetWriteDeadline(time.Now().Add(s.options.MaxWriteWait))
+
+			// only time the ping if we're not still waiting on an answer to the previous one
+			s.pingSentOn.CompareAndSwap(0, time.Now().UnixNano())
 
 			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				s.writeError <- err
+				s.writeFailed(err)
 			}
+
+			s.reportTraffic()
 		case <-s.stopWriter:
 			break out
 		}
 	}
 
 	// try to drain the outbox with a time limit
-	if len(s.outbox) > 0 {
-		s.conn.SetWriteDeadline(time.Now().Add(drainPeriod))
-		for {
-			select {
-			case msg := <-s.outbox:
-				err := s.conn.WriteMessage(msg.type_, msg.data)
-				if err != nil || len(s.outbox) == 0 {
-					return
-				}
-			case <-time.After(drainPeriod):
+	s.conn.SetWriteDeadline(time.Now().Add(s.options.DrainPeriod))
+	drainUntil := time.After(s.options.DrainPeriod)
+
+drain:
+	for len(s.outbox) > 0 {
+		select {
+		case msg := <-s.outbox:
+			if err := s.write(msg); err != nil {
 				return
 			}
+		case <-drainUntil:
+			break drain
 		}
 	}
+
+	// if we initiated the close, let the other side know
+	s.mutex.Lock()
+	closeFrame, code := s.closeFrame, s.closingWithCode
+	s.mutex.Unlock()
+
+	if closeFrame {
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+	}
+}
+
+// writes the given message to the connection, counting it if successful
+func (s *socket) write(msg message) error {
+	if err := s.conn.WriteMessage(msg.type_, msg.data); err != nil {
+		return err
+	}
+
+	s.messagesOut.Add(1)
+	s.bytesOut.Add(int64(len(msg.data)))
+	return nil
+}
+
+// reports a write error to the monitor unless one has already been reported
+func (s *socket) writeFailed(err error) {
+	select {
+	case s.writeError <- err:
+	default:
+	}
 }
 
 func defaultOnMessage([]byte) {}
@@ -0,0 +1,328 @@
+package httpx
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketState is the connection state of a client web socket
+type WebSocketState int
+
+// possible client web socket states
+const (
+	WebSocketConnecting WebSocketState = iota
+	WebSocketConnected
+	WebSocketReconnecting
+	WebSocketClosed
+)
+
+func (s WebSocketState) String() string {
+	return [...]string{"connecting", "connected", "reconnecting", "closed"}[s]
+}
+
+// ClientWebSocket is a client side web socket which dials a URL and reconnects if the connection is lost. Messages sent
+// whilst it's not connected are buffered (up to the send buffer size, after which the oldest are discarded) and sent
+// once it reconnects.
+type ClientWebSocket struct {
+	url     string
+	header  http.Header
+	options *WebSocketOptions
+	retries *RetryConfig
+
+	mutex   sync.Mutex
+	state   WebSocketState
+	current *socket
+	pending []message
+	totals  WebSocketStats // stats of previous connections and of messages dropped whilst not connected
+	started bool
+	closing bool
+	stop    chan bool
+
+	onMessage     func([]byte)
+	onClose       func(int)
+	onStateChange func(WebSocketState)
+}
+
+// NewClientWebSocket creates a new client web socket which will connect to the given URL when started. If retries is
+// nil, no reconnection attempts are made and the socket closes when the connection fails or is lost.
+func NewClientWebSocket(url string, header http.Header, options *WebSocketOptions, retries *RetryConfig) *ClientWebSocket {
+	return &ClientWebSocket{
+		url:     url,
+		header:  header,
+		options: options.withDefaults(),
+		retries: retries,
+		state:   WebSocketConnecting,
+		stop:    make(chan bool),
+
+		onMessage:     defaultOnMessage,
+		onClose:       defaultOnClose,
+		onStateChange: func(WebSocketState) {},
+	}
+}
+
+func (c *ClientWebSocket) OnMessage(fn func([]byte)) { c.onMessage = fn }
+func (c *ClientWebSocket) OnClose(fn func(int))      { c.onClose = fn }
+
+// OnStateChange is called when the connection state of this socket changes
+func (c *ClientWebSocket) OnStateChange(fn func(WebSocketState)) { c.onStateChange = fn }
+
+// State returns the current connection state of this socket
+func (c *ClientWebSocket) State() WebSocketState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.state
+}
+
+func (c *ClientWebSocket) Subprotocol() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.current != nil {
+		return c.current.Subprotocol()
+	}
+	return ""
+}
+
+// Stats returns the traffic stats for this socket across all of its connections. Messages waiting to be sent when it
+// reconnects are included in the queue depth.
+func (c *ClientWebSocket) Stats() WebSocketStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.totals
+	stats.QueueDepth = len(c.pending)
+
+	if c.current != nil {
+		stats = stats.Add(c.current.Stats())
+	}
+	return stats
+}
+
+// Start begins connecting in the background
+func (c *ClientWebSocket) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.started || c.closing {
+		panic("can't start socket which is already started or closing")
+	}
+	c.started = true
+
+	go c.connect(WebSocketConnecting)
+}
+
+// Send sends the given text message or buffers it if we're not currently connected
+func (c *ClientWebSocket) Send(msg []byte) {
+	if err := c.send(context.Background(), message{type_: websocket.TextMessage, data: msg}); err == ErrSocketClosed {
+		panic("can't send to socket which is closed or closing")
+	}
+}
+
+// SendContext sends the given text message or buffers it if we're not currently connected
+func (c *ClientWebSocket) SendContext(ctx context.Context, msg []byte) error {
+	return c.send(ctx, message{type_: websocket.TextMessage, data: msg})
+}
+
+// SendBinary sends the given binary message or buffers it if we're not currently connected
+func (c *ClientWebSocket) SendBinary(ctx context.Context, msg []byte) error {
+	return c.send(ctx, message{type_: websocket.BinaryMessage, data: msg})
+}
+
+func (c *ClientWebSocket) send(ctx context.Context, msg message) error {
+	c.mutex.Lock()
+
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrSocketClosed
+	}
+
+	current := c.current
+	if current == nil {
+		c.buffer(msg)
+		c.mutex.Unlock()
+		return nil
+	}
+
+	c.mutex.Unlock()
+
+	err := current.send(ctx, msg)
+	if err != ErrSocketClosed {
+		return err
+	}
+
+	// connection was lost so buffer message to send when we reconnect
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return ErrSocketClosed
+	}
+
+	c.buffer(msg)
+	return nil
+}
+
+// Close closes the connection, or stops trying to connect
+func (c *ClientWebSocket) Close(code int) {
+	c.mutex.Lock()
+
+	if c.closing {
+		c.mutex.Unlock()
+		panic("can't close socket which is already closed or closing")
+	}
+	c.closing = true
+	current := c.current
+	c.mutex.Unlock()
+
+	close(c.stop)
+
+	// if we're connected, closing the connection will trigger our close callback
+	if current != nil {
+		if current.startClosing(code, true) {
+			current.monitorWaitGroup.Wait()
+		}
+	} else {
+		c.closed(code)
+	}
+}
+
+// tries to connect, retrying according to our retry config
+func (c *ClientWebSocket) connect(state WebSocketState) {
+	c.setState(state)
+
+	for attempt := 0; ; attempt++ {
+		sock, err := c.dial()
+		if err == nil {
+			c.connected(sock)
+			return
+		}
+
+		if c.retries == nil || attempt >= c.retries.MaxRetries() {
+			break
+		}
+
+		select {
+		case <-time.After(c.retries.Backoff(attempt)):
+		case <-c.stop:
+			return
+		}
+	}
+
+	c.mutex.Lock()
+	closing := c.closing
+	c.closing = true
+	c.mutex.Unlock()
+
+	if !closing {
+		c.closed(websocket.CloseAbnormalClosure)
+	}
+}
+
+func (c *ClientWebSocket) dial() (*socket, error) {
+	dialer := &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  c.options.MaxWriteWait,
+		ReadBufferSize:    c.options.ReadBufferSize,
+		WriteBufferSize:   c.options.WriteBufferSize,
+		Subprotocols:      c.options.Subprotocols,
+		EnableCompression: c.options.EnableCompression,
+	}
+
+	conn, _, err := dialer.Dial(c.url, c.header)
+	if err != nil {
+		return nil, err
+	}
+
+	sock := newSocket(conn, c.options)
+	sock.OnMessage(func(msg []byte) { c.onMessage(msg) })
+	sock.OnClose(func(code int) { c.disconnected(sock, code) })
+	return sock, nil
+}
+
+// called when we've established a new connection
+func (c *ClientWebSocket) connected(sock *socket) {
+	c.mutex.Lock()
+
+	// if we were closed while dialing, abandon this connection
+	if c.closing {
+		c.mutex.Unlock()
+		sock.conn.Close()
+		return
+	}
+
+	c.current = sock
+	c.state = WebSocketConnected
+	sock.Start()
+
+	// buffer can't be bigger than the new socket's outbox so this won't block
+	for _, msg := range c.pending {
+		sock.send(context.Background(), msg)
+	}
+	c.pending = nil
+
+	c.mutex.Unlock()
+
+	c.onStateChange(WebSocketConnected)
+}
+
+// called when a connection closes, whether we closed it or not
+func (c *ClientWebSocket) disconnected(sock *socket, code int) {
+	c.mutex.Lock()
+
+	if c.current != sock {
+		c.mutex.Unlock()
+		return
+	}
+	c.current = nil
+
+	stats := sock.Stats()
+	stats.QueueDepth, stats.PingLatency = 0, 0
+	c.totals = c.totals.Add(stats)
+
+	if c.closing || c.retries == nil {
+		c.closing = true
+		c.mutex.Unlock()
+		c.closed(code)
+		return
+	}
+
+	c.mutex.Unlock()
+
+	go c.connect(WebSocketReconnecting)
+}
+
+func (c *ClientWebSocket) closed(code int) {
+	c.setState(WebSocketClosed)
+	c.onClose(code)
+}
+
+func (c *ClientWebSocket) setState(state WebSocketState) {
+	c.mutex.Lock()
+
+	// once closed, we stay closed
+	if c.state == WebSocketClosed {
+		c.mutex.Unlock()
+		return
+	}
+
+	c.state = state
+	c.mutex.Unlock()
+
+	c.onStateChange(state)
+}
+
+// buffers the given message to send when we reconnect, must be called with the socket locked
+func (c *ClientWebSocket) buffer(msg message) {
+	if len(c.pending) >= max(c.options.SendBuffer, 1) {
+		c.pending = c.pending[1:]
+		c.totals.MessagesDropped++
+	}
+	c.pending = append(c.pending, msg)
+}
+
+var _ WebSocket = (*ClientWebSocket)(nil)
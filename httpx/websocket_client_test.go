@@ -0,0 +1,130 @@
+package httpx_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientWebSocket(t *testing.T) {
+	var serverSocks []httpx.WebSocket
+	var serverReceived []string
+	var serverMutex sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sock, err := httpx.NewWebSocket(w, r, 4096, 5)
+		require.NoError(t, err)
+
+		sock.OnMessage(func(b []byte) {
+			serverMutex.Lock()
+			serverReceived = append(serverReceived, string(b))
+			serverMutex.Unlock()
+		})
+		sock.Start()
+
+		serverMutex.Lock()
+		serverSocks = append(serverSocks, sock)
+		serverMutex.Unlock()
+	}))
+	serverURL := "ws:" + strings.TrimPrefix(server.URL, "http:")
+
+	states := make(chan httpx.WebSocketState, 10)
+	var clientReceived []string
+	var clientMutex sync.Mutex
+	var clientCloseCode int
+
+	client := httpx.NewClientWebSocket(serverURL, nil, httpx.NewWebSocketOptions(4096, 3), httpx.NewFixedRetries(100*time.Millisecond, 100*time.Millisecond))
+	client.OnStateChange(func(s httpx.WebSocketState) { states <- s })
+	client.OnMessage(func(b []byte) {
+		clientMutex.Lock()
+		clientReceived = append(clientReceived, string(b))
+		clientMutex.Unlock()
+	})
+	client.OnClose(func(code int) { clientCloseCode = code })
+
+	assert.Equal(t, httpx.WebSocketConnecting, client.State())
+
+	// messages sent before we're connected are buffered
+	client.Send([]byte("early"))
+
+	client.Start()
+
+	assert.Equal(t, httpx.WebSocketConnecting, <-states)
+	assert.Equal(t, httpx.WebSocketConnected, <-states)
+	assert.Equal(t, httpx.WebSocketConnected, client.State())
+
+	client.Send([]byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	serverMutex.Lock()
+	assert.Equal(t, []string{"early", "hello"}, serverReceived)
+	serverSocks[0].Send([]byte("hi there"))
+	serverMutex.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	clientMutex.Lock()
+	assert.Equal(t, []string{"hi there"}, clientReceived)
+	clientMutex.Unlock()
+
+	// server closes the connection so client reconnects
+	serverMutex.Lock()
+	serverSocks[0].Close(1001)
+	serverMutex.Unlock()
+
+	assert.Equal(t, httpx.WebSocketReconnecting, <-states)
+
+	client.Send([]byte("while reconnecting"))
+
+	assert.Equal(t, httpx.WebSocketConnected, <-states)
+	time.Sleep(100 * time.Millisecond)
+
+	serverMutex.Lock()
+	assert.Len(t, serverSocks, 2)
+	assert.Equal(t, []string{"early", "hello", "while reconnecting"}, serverReceived)
+	serverMutex.Unlock()
+
+	// stats are totals across both connections
+	stats := client.Stats()
+	assert.Equal(t, int64(1), stats.MessagesIn)
+	assert.Equal(t, int64(3), stats.MessagesOut)
+	assert.Equal(t, int64(28), stats.BytesOut)
+	assert.Equal(t, 0, stats.QueueDepth)
+
+	// close from the client side
+	client.Close(1000)
+
+	assert.Equal(t, httpx.WebSocketClosed, <-states)
+	assert.Equal(t, 1000, clientCloseCode)
+
+	assert.Panics(t, func() { client.Send([]byte("x")) })
+	assert.Panics(t, func() { client.Close(1000) })
+	assert.Panics(t, func() { client.Start() })
+}
+
+func TestClientWebSocketGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	states := make(chan httpx.WebSocketState, 10)
+	closed := make(chan int, 1)
+
+	client := httpx.NewClientWebSocket("ws:"+strings.TrimPrefix(server.URL, "http:"), nil, httpx.NewWebSocketOptions(4096, 3), httpx.NewFixedRetries(10*time.Millisecond, 10*time.Millisecond))
+	client.OnStateChange(func(s httpx.WebSocketState) { states <- s })
+	client.OnClose(func(code int) { closed <- code })
+	client.Start()
+
+	assert.Equal(t, 1006, <-closed)
+	assert.Equal(t, httpx.WebSocketConnecting, <-states)
+	assert.Equal(t, httpx.WebSocketClosed, <-states)
+	assert.Equal(t, "closed", client.State().String())
+}
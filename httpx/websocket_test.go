@@ -1,6 +1,8 @@
 package httpx_test
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nyaruka/gocommon/analytics"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -154,3 +157,267 @@ func TestSocketClientCloseWithoutMessage(t *testing.T) {
 
 	assert.Equal(t, websocket.CloseAbnormalClosure, serverCloseCode)
 }
+
+func TestSocketOptions(t *testing.T) {
+	type upgrade struct {
+		sock httpx.WebSocket
+		err  error
+	}
+
+	options := httpx.NewWebSocketOptions(4096, 5)
+	options.PingPeriod = 100 * time.Millisecond
+	options.AllowedOrigins = []string{"https://textit.com", "*.nyaruka.com"}
+	options.Subprotocols = []string{"p2", "p3"}
+	options.EnableCompression = true
+
+	upgrades := make(chan upgrade, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sock, err := httpx.NewWebSocketWithOptions(w, r, options)
+		if err == nil {
+			sock.Start()
+		}
+		upgrades <- upgrade{sock, err}
+	}))
+	serverURL := "ws:" + strings.TrimPrefix(s.URL, "http:")
+
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		d := websocket.Dialer{Subprotocols: []string{"p1", "p2"}, EnableCompression: true, HandshakeTimeout: 30 * time.Second}
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		return d.Dial(serverURL, header)
+	}
+
+	// origin not in allowed list
+	_, resp, err := dial("https://evil.com")
+	assert.EqualError(t, err, "websocket: bad handshake")
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.EqualError(t, (<-upgrades).err, "websocket: request origin not allowed by Upgrader.CheckOrigin")
+
+	// origins matching a glob are allowed as are requests without an origin
+	conn, _, err := dial("https://chat.nyaruka.com")
+	assert.NoError(t, err)
+	assert.NoError(t, (<-upgrades).err)
+	conn.Close()
+
+	conn, resp, err = dial("")
+	assert.NoError(t, err)
+
+	u := <-upgrades
+	require.NoError(t, u.err)
+	sock := u.sock
+
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", resp.Header.Get("Sec-Websocket-Extensions"))
+
+	// first subprotocol supported by both is used
+	assert.Equal(t, "p2", conn.Subprotocol())
+	assert.Equal(t, "p2", sock.Subprotocol())
+
+	// and pings are sent with the configured period
+	pings := 0
+	conn.SetPingHandler(func(string) error { pings++; return nil })
+
+	time.Sleep(250 * time.Millisecond)
+	sock.Send([]byte("hi"))
+
+	_, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(msg))
+	assert.GreaterOrEqual(t, pings, 2)
+
+	sock.Close(1000)
+}
+
+func TestSocketSendContext(t *testing.T) {
+	socks := make(chan httpx.WebSocket, 1)
+
+	serverURL := newSocketServer(t, func(ws httpx.WebSocket) {
+		ws.Start()
+		socks <- ws
+	})
+
+	conn := newSocketConnection(t, serverURL)
+	sock := <-socks
+
+	// can send binary messages as well as text
+	err := sock.SendBinary(context.Background(), []byte{0x01, 0x02})
+	assert.NoError(t, err)
+
+	msgType, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, msgType)
+	assert.Equal(t, []byte{0x01, 0x02}, msg)
+
+	err = sock.SendContext(context.Background(), []byte("text"))
+	assert.NoError(t, err)
+
+	msgType, msg, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, msgType)
+	assert.Equal(t, "text", string(msg))
+
+	sock.Close(1000)
+
+	// sending to a closed socket returns an error rather than panicking
+	assert.Equal(t, httpx.ErrSocketClosed, sock.SendContext(context.Background(), []byte("x")))
+	assert.Equal(t, httpx.ErrSocketClosed, sock.SendBinary(context.Background(), []byte("x")))
+}
+
+func TestSocketSendPolicies(t *testing.T) {
+	newServerSocket := func(options *httpx.WebSocketOptions) (httpx.WebSocket, *websocket.Conn) {
+		socks := make(chan httpx.WebSocket, 1)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sock, err := httpx.NewWebSocketWithOptions(w, r, options)
+			require.NoError(t, err)
+			socks <- sock
+		}))
+
+		conn := newSocketConnection(t, "ws:"+strings.TrimPrefix(s.URL, "http:"))
+		return <-socks, conn
+	}
+
+	readAll := func(conn *websocket.Conn) ([]string, int) {
+		var msgs []string
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return msgs, err.(*websocket.CloseError).Code
+			}
+			msgs = append(msgs, string(msg))
+		}
+	}
+
+	// sockets aren't started until after sending so their outboxes of 2 messages don't empty
+	options := httpx.NewWebSocketOptions(4096, 2)
+
+	// blocking policy gives up when context is done
+	sock, conn := newServerSocket(options)
+	assert.NoError(t, sock.SendContext(context.Background(), []byte("m1")))
+	assert.NoError(t, sock.SendContext(context.Background(), []byte("m2")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, sock.SendContext(ctx, []byte("m3")))
+
+	sock.Start()
+	sock.Close(1000)
+
+	msgs, code := readAll(conn)
+	assert.Equal(t, []string{"m1", "m2"}, msgs)
+	assert.Equal(t, 1000, code)
+
+	// drop oldest policy discards the oldest queued messages
+	options.SendPolicy = httpx.SendDropOldest
+	sock, conn = newServerSocket(options)
+	for _, m := range []string{"m1", "m2", "m3", "m4"} {
+		assert.NoError(t, sock.SendContext(context.Background(), []byte(m)))
+	}
+
+	sock.Start()
+	sock.Close(1000)
+
+	msgs, code = readAll(conn)
+	assert.Equal(t, []string{"m3", "m4"}, msgs)
+	assert.Equal(t, 1000, code)
+
+	// disconnect policy closes the socket if client isn't reading fast enough
+	var err error
+	options.SendPolicy = httpx.SendDisconnect
+	options.MaxWriteWait = 250 * time.Millisecond
+	options.DrainPeriod = 250 * time.Millisecond
+	sock, _ = newServerSocket(options)
+
+	closed := make(chan int, 1)
+	sock.OnClose(func(code int) { closed <- code })
+	sock.Start()
+
+	// send big messages until network buffers and outbox are full
+	big := bytes.Repeat([]byte("x"), 1024*1024)
+	for i := 0; i < 1000; i++ {
+		if err = sock.SendContext(context.Background(), big); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t, httpx.ErrSocketOutboxFull, err)
+	assert.Equal(t, websocket.ClosePolicyViolation, <-closed)
+	assert.Equal(t, httpx.ErrSocketClosed, sock.SendContext(context.Background(), big))
+}
+
+func TestSocketStats(t *testing.T) {
+	mock := analytics.NewMock()
+	analytics.RegisterBackend(mock)
+	defer analytics.RemoveBackend(mock)
+
+	options := httpx.NewWebSocketOptions(4096, 5)
+	options.PingPeriod = 50 * time.Millisecond
+	options.AnalyticsPrefix = "ws"
+
+	socks := make(chan httpx.WebSocket, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sock, err := httpx.NewWebSocketWithOptions(w, r, options)
+		require.NoError(t, err)
+
+		sock.Start()
+		socks <- sock
+	}))
+
+	conn := newSocketConnection(t, "ws:"+strings.TrimPrefix(s.URL, "http:"))
+	sock := <-socks
+
+	assert.Equal(t, httpx.WebSocketStats{}, sock.Stats())
+
+	sock.Send([]byte("hello"))
+	assert.NoError(t, sock.SendBinary(context.Background(), []byte{1, 2, 3}))
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hi there"))
+
+	// client must be reading for pings to be answered
+	for i := 0; i < 2; i++ {
+		_, _, err := conn.ReadMessage()
+		assert.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	sock.Send([]byte("dummy"))
+	conn.ReadMessage()
+
+	stats := sock.Stats()
+	assert.Equal(t, int64(1), stats.MessagesIn)
+	assert.Equal(t, int64(8), stats.BytesIn)
+	assert.Equal(t, int64(3), stats.MessagesOut)
+	assert.Equal(t, int64(13), stats.BytesOut)
+	assert.Equal(t, int64(0), stats.MessagesDropped)
+	assert.Equal(t, 0, stats.QueueDepth)
+	assert.Greater(t, stats.PingLatency, time.Duration(0))
+
+	sock.Close(1000)
+
+	// traffic is recorded in increments which add up to the totals
+	sum := func(vals []float64) float64 {
+		total := 0.0
+		for _, v := range vals {
+			total += v
+		}
+		return total
+	}
+
+	assert.Greater(t, len(mock.Gauges["ws.ping_latency"]), 0)
+	assert.Greater(t, len(mock.Gauges["ws.messages_in"]), 1)
+	assert.Equal(t, float64(1), sum(mock.Gauges["ws.messages_in"]))
+	assert.Equal(t, float64(3), sum(mock.Gauges["ws.messages_out"]))
+	assert.Equal(t, float64(0), sum(mock.Gauges["ws.messages_dropped"]))
+	assert.Equal(t, float64(8), sum(mock.Gauges["ws.bytes_in"]))
+	assert.Equal(t, float64(13), sum(mock.Gauges["ws.bytes_out"]))
+
+	// stats can be combined
+	assert.Equal(t, httpx.WebSocketStats{MessagesIn: 3, BytesOut: 10, QueueDepth: 2, PingLatency: time.Second}, httpx.WebSocketStats{
+		MessagesIn: 1, BytesOut: 4, QueueDepth: 2, PingLatency: time.Second,
+	}.Add(httpx.WebSocketStats{
+		MessagesIn: 2, BytesOut: 6, PingLatency: time.Millisecond,
+	}))
+}
@@ -1,50 +1,92 @@
 package syncx
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrBatcherStopped is returned when trying to queue to a batcher which has been stopped
+var ErrBatcherStopped = errors.New("batcher is stopped")
+
+// ErrBatcherFull is returned when trying to queue to a batcher whose buffer is full without blocking
+var ErrBatcherFull = errors.New("batcher buffer is full")
+
+// ErrBatcherAbandoned is passed to the dead letter callback of a retrying batcher with items which were abandoned
+var ErrBatcherAbandoned = errors.New("batcher was abandoned")
+
 // Batcher allows values to be queued and processed in a background thread.
 type Batcher[T any] struct {
-	process  func(batch []T)
-	maxItems int
-	maxAge   time.Duration
+	process   func(batch []T)
+	onAbandon func(items []T)
+	maxItems  int
+	maxAge    time.Duration
 
 	wg      *sync.WaitGroup
 	buffer  chan T
 	stop    chan bool
+	abandon chan bool
+	done    chan bool
 	batch   []T
+	batched atomic.Int64 // size of batch which can be read by queuers
 	timeout <-chan time.Time
+
+	// queuers hold a read lock so that stopping waits for them to finish
+	mutex   sync.RWMutex
+	stopped bool
+
+	abandonOnce sync.Once
 }
 
 // NewBatcher creates a new batcher. Queued items are passed to the `process` callback in batches of `maxItems` maximum
 // size. Processing of a batch is triggered by reaching `maxItems` or `maxAge` since the oldest unprocessed item was queued.
 func NewBatcher[T any](process func(batch []T), maxItems int, maxAge time.Duration, bufferSize int, wg *sync.WaitGroup) *Batcher[T] {
 	return &Batcher[T]{
-		process:  process,
-		maxItems: maxItems,
-		maxAge:   maxAge,
-		wg:       wg,
-		buffer:   make(chan T, bufferSize),
-		stop:     make(chan bool),
-		batch:    make([]T, 0, maxItems),
-		timeout:  nil,
+		process:   process,
+		onAbandon: func([]T) {},
+		maxItems:  maxItems,
+		maxAge:    maxAge,
+		wg:        wg,
+		buffer:    make(chan T, bufferSize),
+		stop:      make(chan bool),
+		abandon:   make(chan bool),
+		done:      make(chan bool),
+		batch:     make([]T, 0, maxItems),
+		timeout:   nil,
 	}
 }
 
+// OnAbandon is called with items which weren't processed because the batcher was abandoned by StopContext. It may be
+// called more than once if blocked queuers add more items after abandonment.
+func (b *Batcher[T]) OnAbandon(fn func(items []T)) { b.onAbandon = fn }
+
 // Start starts this batcher's background processing, returning immediately.
 func (b *Batcher[T]) Start() {
 	b.wg.Add(1)
 
 	go func() {
 		defer b.wg.Done()
+		defer close(b.done)
 
 		for {
 			select {
 			case v := <-b.buffer:
 				b.batch = append(b.batch, v)
 
+				// once abandoned, items are handed off rather than processed so that any blocked queuers can finish and
+				// stopping can complete
+				if b.abandoned() {
+					b.abandonRemaining()
+					continue
+				}
+
+				b.batched.Store(int64(len(b.batch)))
+
 				// if this is the first item in the batch we need to restart the age timeout
 				if b.timeout == nil {
 					b.timeout = time.After(b.maxAge)
@@ -57,7 +99,11 @@ func (b *Batcher[T]) Start() {
 
 			case <-b.timeout:
 				// flush whatever we have
-				b.flush()
+				if b.abandoned() {
+					b.abandonRemaining()
+				} else {
+					b.flush()
+				}
 
 			case <-b.stop:
 				b.drain()
@@ -68,16 +114,97 @@ func (b *Batcher[T]) Start() {
 	}()
 }
 
-// Queue queues the given value, potentially blocking. Returns the new free capacity (batch + buffer).
+// Queue queues the given value, potentially blocking. Returns the new free capacity (batch + buffer). If the batcher
+// has been stopped, the value is dropped and zero returned - use TryQueue or QueueContext to get an error instead.
 func (b *Batcher[T]) Queue(value T) int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.stopped {
+		return 0
+	}
+
 	b.buffer <- value
 
-	return (cap(b.batch) + cap(b.buffer)) - (len(b.batch) + len(b.buffer))
+	return b.capacity()
+}
+
+// TryQueue queues the given value without blocking, returning ErrBatcherFull if the buffer is full or
+// ErrBatcherStopped if the batcher has been stopped. Returns the new free capacity (batch + buffer).
+func (b *Batcher[T]) TryQueue(value T) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.stopped {
+		return 0, ErrBatcherStopped
+	}
+
+	select {
+	case b.buffer <- value:
+		return b.capacity(), nil
+	default:
+		return 0, ErrBatcherFull
+	}
+}
+
+// QueueContext queues the given value, blocking until there is room in the buffer or the context is done. Returns
+// ErrBatcherStopped if the batcher has been stopped. Returns the new free capacity (batch + buffer).
+func (b *Batcher[T]) QueueContext(ctx context.Context, value T) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.stopped {
+		return 0, ErrBatcherStopped
+	}
+
+	select {
+	case b.buffer <- value:
+		return b.capacity(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
-// Stop stops this batcher.
+// Stop stops this batcher. Queued items are still processed but further queuing isn't allowed. Callers can wait for
+// processing to complete using the wait group.
 func (b *Batcher[T]) Stop() {
-	close(b.stop)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.stopped {
+		b.stopped = true
+		close(b.stop)
+	}
+}
+
+// StopContext stops this batcher and waits for queued items to be processed until the context is done, at which point
+// any remaining items are abandoned after the batch currently being processed, and the context error is returned.
+// Abandoned items are passed to the OnAbandon callback. The context also bounds waiting for blocked queuers to finish,
+// in which case stopping completes in the background.
+func (b *Batcher[T]) StopContext(ctx context.Context) error {
+	go b.Stop()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		b.abandonOnce.Do(func() { close(b.abandon) })
+
+		return ctx.Err()
+	}
+}
+
+func (b *Batcher[T]) abandoned() bool {
+	select {
+	case <-b.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Batcher[T]) capacity() int {
+	return (b.maxItems + cap(b.buffer)) - (int(b.batched.Load()) + len(b.buffer))
 }
 
 // flushes whatever has been batched
@@ -85,13 +212,35 @@ func (b *Batcher[T]) flush() {
 	if len(b.batch) > 0 {
 		b.process(b.batch)
 		b.batch = make([]T, 0, b.maxItems)
+		b.batched.Store(0)
 		b.timeout = nil
 	}
 }
 
-// processes everything in the batch and buffer until they're both empty
+// hands off everything in the batch and buffer to the abandon callback
+func (b *Batcher[T]) abandonRemaining() {
+	items := b.batch
+	for len(b.buffer) > 0 {
+		items = append(items, <-b.buffer)
+	}
+
+	b.batch = make([]T, 0, b.maxItems)
+	b.batched.Store(0)
+	b.timeout = nil
+
+	if len(items) > 0 {
+		b.onAbandon(items)
+	}
+}
+
+// processes everything in the batch and buffer until they're both empty, or we're told to abandon them
 func (b *Batcher[T]) drain() {
 	for len(b.buffer) > 0 || len(b.batch) > 0 {
+		if b.abandoned() {
+			b.abandonRemaining()
+			return
+		}
+
 		buffSize := len(b.buffer)
 		canRead := min(b.maxItems-len(b.batch), buffSize)
 
@@ -99,7 +248,98 @@ func (b *Batcher[T]) drain() {
 			v := <-b.buffer
 			b.batch = append(b.batch, v)
 		}
+		b.batched.Store(int64(len(b.batch)))
 
 		b.flush()
 	}
 }
+
+// ItemErrors can be returned from processing a batch to report that only some items failed, keyed by their index in
+// the batch
+type ItemErrors map[int]error
+
+func (e ItemErrors) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for i, idx := range indexes {
+		msgs[i] = fmt.Sprintf("item %d: %s", idx, e[idx])
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// RetryingBatcher is a batcher whose process callback can fail. Failed batches are retried after each of the given
+// backoffs, and if they still fail, passed to the dead letter callback. If processing returns ItemErrors, only the
+// items which failed are retried. Batches are retried in the background thread so later batches wait until retrying
+// completes. If the batcher is abandoned by StopContext, retrying stops and the items being retried are passed to the
+// dead letter callback, as are any items which were still queued, with ErrBatcherAbandoned.
+type RetryingBatcher[T any] struct {
+	*Batcher[T]
+
+	process      func(batch []T) error
+	backoffs     []time.Duration
+	onDeadLetter func([]T, error)
+}
+
+// NewRetryingBatcher creates a new retrying batcher
+func NewRetryingBatcher[T any](process func(batch []T) error, backoffs []time.Duration, maxItems int, maxAge time.Duration, bufferSize int, wg *sync.WaitGroup) *RetryingBatcher[T] {
+	b := &RetryingBatcher[T]{
+		process:      process,
+		backoffs:     backoffs,
+		onDeadLetter: func([]T, error) {},
+	}
+	b.Batcher = NewBatcher(b.processWithRetries, maxItems, maxAge, bufferSize, wg)
+	b.Batcher.OnAbandon(func(items []T) { b.onDeadLetter(items, ErrBatcherAbandoned) })
+	return b
+}
+
+// OnDeadLetter is called with items which couldn't be processed after all retries, and the last error. If the error is
+// ItemErrors, it is keyed by index in the dead letter batch.
+func (b *RetryingBatcher[T]) OnDeadLetter(fn func(batch []T, err error)) { b.onDeadLetter = fn }
+
+func (b *RetryingBatcher[T]) processWithRetries(batch []T) {
+	for retry := 0; ; retry++ {
+		err := b.process(batch)
+
+		// if only some items failed, we only retry those
+		var itemErrs ItemErrors
+		if errors.As(err, &itemErrs) {
+			batch, itemErrs = failedItems(batch, itemErrs)
+			err = itemErrs
+		}
+
+		if err == nil || len(batch) == 0 {
+			return
+		}
+
+		if retry >= len(b.backoffs) {
+			b.onDeadLetter(batch, err)
+			return
+		}
+
+		select {
+		case <-time.After(b.backoffs[retry]):
+		case <-b.abandon:
+			b.onDeadLetter(batch, err)
+			return
+		}
+	}
+}
+
+// returns the failed items from the given batch and their errors keyed by their new indexes
+func failedItems[T any](batch []T, errs ItemErrors) ([]T, ItemErrors) {
+	failed := make([]T, 0, len(errs))
+	failedErrs := make(ItemErrors, len(errs))
+
+	for i, item := range batch {
+		if err, ok := errs[i]; ok {
+			failedErrs[len(failed)] = err
+			failed = append(failed, item)
+		}
+	}
+	return failed, failedErrs
+}
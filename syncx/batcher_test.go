@@ -1,7 +1,11 @@
 package syncx_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -55,8 +59,235 @@ func TestBatcher(t *testing.T) {
 
 	assert.Equal(t, [][]int{{1, 2}, {3, 4}, {5}, {6, 7}, {8}}, batches)
 
-	// panic if you try to queue to a stopped batcher
-	assert.Panics(t, func() {
-		b.Queue(9)
+	// queuing to a stopped batcher drops the item
+	assert.Equal(t, 0, b.Queue(9))
+	assert.Equal(t, [][]int{{1, 2}, {3, 4}, {5}, {6, 7}, {8}}, batches)
+}
+
+func TestRetryingBatcher(t *testing.T) {
+	var attempts [][]int
+	var deadLetters [][]int
+	var deadLetterErrs []string
+
+	wg := &sync.WaitGroup{}
+	b := syncx.NewRetryingBatcher(func(batch []int) error {
+		attempts = append(attempts, batch)
+
+		switch batch[0] {
+		case 1:
+			// fails first time only
+			if len(attempts) == 1 {
+				return errors.New("boom")
+			}
+		case 3:
+			// always fails
+			return errors.New("bang")
+		case 5, 6:
+			// even items always fail
+			errs := syncx.ItemErrors{}
+			for i, v := range batch {
+				if v%2 == 0 {
+					errs[i] = fmt.Errorf("%d is invalid", v)
+				}
+			}
+			return errs
+		}
+		return nil
+	}, []time.Duration{time.Millisecond * 10, time.Millisecond * 20}, 2, time.Second, 10, wg)
+
+	b.OnDeadLetter(func(batch []int, err error) {
+		deadLetters = append(deadLetters, batch)
+		deadLetterErrs = append(deadLetterErrs, err.Error())
+	})
+
+	b.Start()
+
+	b.Queue(1)
+	b.Queue(2)
+	b.Queue(3)
+	b.Queue(4)
+	b.Queue(5)
+	b.Queue(6)
+
+	b.Stop()
+	wg.Wait()
+
+	assert.Equal(t, [][]int{
+		{1, 2}, {1, 2}, // retried once and succeeds
+		{3, 4}, {3, 4}, {3, 4}, // retried twice and dead lettered
+		{5, 6}, {6}, {6}, // only failing items are retried
+	}, attempts)
+	assert.Equal(t, [][]int{{3, 4}, {6}}, deadLetters)
+	assert.Equal(t, []string{"bang", "item 0: 6 is invalid"}, deadLetterErrs)
+
+	assert.Equal(t, "item 0: a, item 3: b", syncx.ItemErrors{3: errors.New("b"), 0: errors.New("a")}.Error())
+}
+
+func TestBatcherQueueVariants(t *testing.T) {
+	var batches [][]int
+	var batchesMutex sync.Mutex
+	unblock := make(chan bool)
+
+	wg := &sync.WaitGroup{}
+	b := syncx.NewBatcher(func(batch []int) {
+		<-unblock
+
+		batchesMutex.Lock()
+		batches = append(batches, batch)
+		batchesMutex.Unlock()
+	}, 2, time.Second, 2, wg)
+
+	// fill the buffer before starting
+	free, err := b.TryQueue(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, free)
+	free, err = b.TryQueue(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, free)
+
+	_, err = b.TryQueue(3)
+	assert.Equal(t, syncx.ErrBatcherFull, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = b.QueueContext(ctx, 3)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	b.Start()
+
+	// first batch is being processed so buffer has room
+	time.Sleep(50 * time.Millisecond)
+	_, err = b.QueueContext(context.Background(), 3)
+	assert.NoError(t, err)
+
+	unblock <- true
+	time.Sleep(50 * time.Millisecond)
+
+	b.Stop()
+	b.Stop() // noop
+
+	_, err = b.TryQueue(4)
+	assert.Equal(t, syncx.ErrBatcherStopped, err)
+	_, err = b.QueueContext(context.Background(), 4)
+	assert.Equal(t, syncx.ErrBatcherStopped, err)
+	assert.Equal(t, 0, b.Queue(4))
+
+	unblock <- true
+	wg.Wait()
+
+	assert.Equal(t, [][]int{{1, 2}, {3}}, batches)
+}
+
+func TestBatcherStopContext(t *testing.T) {
+	var batches [][]int
+	var batchesMutex sync.Mutex
+
+	getBatches := func() [][]int {
+		batchesMutex.Lock()
+		defer batchesMutex.Unlock()
+		return batches
+	}
+
+	wg := &sync.WaitGroup{}
+	b := syncx.NewBatcher(func(batch []int) {
+		time.Sleep(100 * time.Millisecond)
+		batchesMutex.Lock()
+		batches = append(batches, batch)
+		batchesMutex.Unlock()
+	}, 1, time.Second, 5, wg)
+
+	var abandoned [][]int
+	b.OnAbandon(func(items []int) { abandoned = append(abandoned, items) })
+	b.Start()
+
+	for i := 1; i <= 5; i++ {
+		b.Queue(i)
+	}
+
+	// only enough time to process some of the queued items
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, b.StopContext(ctx))
+
+	wg.Wait()
+
+	assert.Equal(t, [][]int{{1}, {2}, {3}}, getBatches())
+	assert.Equal(t, [][]int{{4, 5}}, abandoned)
+
+	// if processing completes within the time limit, no error
+	batchesMutex.Lock()
+	batches = nil
+	batchesMutex.Unlock()
+
+	b = syncx.NewBatcher(func(batch []int) {
+		batchesMutex.Lock()
+		batches = append(batches, batch)
+		batchesMutex.Unlock()
+	}, 2, time.Second, 5, wg)
+	b.Start()
+	b.Queue(1)
+	b.Queue(2)
+	b.Queue(3)
+
+	assert.NoError(t, b.StopContext(context.Background()))
+	assert.Equal(t, [][]int{{1, 2}, {3}}, getBatches())
+
+	// a queuer blocked on a full buffer doesn't prevent the context from bounding stopping
+	unblock := make(chan bool)
+	b = syncx.NewBatcher(func(batch []int) { <-unblock }, 1, time.Second, 1, wg)
+	b.Start()
+	b.Queue(1) // taken by processing which is blocked
+	b.Queue(2) // fills the buffer
+
+	go b.Queue(3) // blocks holding the queuing lock
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, b.StopContext(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(unblock)
+	wg.Wait()
+}
+
+func TestRetryingBatcherAbandon(t *testing.T) {
+	var attempts atomic.Int32
+	var deadLetters [][]int
+	var deadLetterErrs []error
+	var deadLettersMutex sync.Mutex
+
+	wg := &sync.WaitGroup{}
+	b := syncx.NewRetryingBatcher(func(batch []int) error {
+		attempts.Add(1)
+		return errors.New("boom")
+	}, []time.Duration{time.Hour, time.Hour}, 1, time.Second, 5, wg)
+
+	b.OnDeadLetter(func(batch []int, err error) {
+		deadLettersMutex.Lock()
+		deadLetters = append(deadLetters, batch)
+		deadLetterErrs = append(deadLetterErrs, err)
+		deadLettersMutex.Unlock()
 	})
+
+	b.Start()
+	b.Queue(1)
+	b.Queue(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// abandoning stops the retry wait and the batch goes to the dead letter callback, followed by the queued items
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, b.StopContext(ctx))
+	wg.Wait()
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.Equal(t, [][]int{{1}, {2}}, deadLetters)
+	assert.Equal(t, []error{errors.New("boom"), syncx.ErrBatcherAbandoned}, deadLetterErrs)
 }